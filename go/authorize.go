@@ -0,0 +1,144 @@
+package tolliver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/match"
+)
+
+// Something a remote asks an instance to do on a channel key pair
+type Action string
+
+const (
+	// Sending a message to the instance
+	ActionPublish Action = "publish"
+	// Subscribing to messages from the instance, or asking it to replay or deliver retained messages
+	ActionSubscribe Action = "subscribe"
+)
+
+var ErrUnauthorized = errors.New("The remote isn't allowed to do that")
+
+// A remote as seen by an Authorizer
+type Peer struct {
+	// The UUID the remote claimed in its handshake, which is only bound to its certificate if the instance has an
+	// IdentityPolicy
+	ID uuid.UUID
+	// The certificate the remote presented, which has been verified against the CA unless
+	// InstanceOptions.InsecureSkipVerify is set
+	Certificate *x509.Certificate
+}
+
+// Decides what remotes may publish to and subscribe to on an instance. Messages a remote isn't allowed to publish are
+// dropped without being passed to handlers and, if reliable, acked with the denied status so the sender stops resending
+// them. Subscription and replay messages the remote isn't allowed to send are applied in full or not at all, while
+// subscriptions presented in a handshake which aren't allowed are ignored. Replies to requests are never checked, since
+// they are only passed to the Request call waiting for them.
+//
+// Authorize is called from the goroutine reading the remote's connection, so nothing else from the remote is read until
+// it returns.
+type Authorizer interface {
+	// Returns nil if the remote may take the action on the channel key pair, or an error saying why not, which is sent
+	// back to the remote. For ActionSubscribe the channel may be a pattern and the key may be blank, meaning every key.
+	Authorize(ctx context.Context, peer Peer, action Action, channel, key string) error
+}
+
+// Allows an action when it is covered by a rule, see AuthRule. Anything no rule covers is denied.
+type StaticAuthorizer struct {
+	rules []AuthRule
+}
+
+// Allows remotes to take the listed actions on channel key pairs. Fields left blank match anything.
+type AuthRule struct {
+	// UUID of the remote the rule applies to, omit for any remote
+	Remote uuid.UUID `json:"remote"`
+	// Subject common name the remote's certificate must have, blank for any
+	CommonName string `json:"common_name"`
+	// What the rule allows, empty for every action
+	Actions []Action `json:"actions"`
+	// Channel the rule allows, which may be a pattern. A subscription is only allowed if the pattern matches every
+	// channel the subscription would.
+	Channel string `json:"channel"`
+	// Key the rule allows, blank for every key
+	Key string `json:"key"`
+}
+
+func NewStaticAuthorizer(rules []AuthRule) *StaticAuthorizer {
+	return &StaticAuthorizer{rules: slices.Clone(rules)}
+}
+
+// Reads a StaticAuthorizer's rules from a JSON file holding a list of AuthRule objects, e.g.
+//
+//	[
+//	  {"common_name": "gateway.tug.dev", "actions": ["publish"], "channel": "vm.>"},
+//	  {"remote": "01a1481a-32cb-7678-817a-b2c6e710795d", "actions": ["subscribe"], "channel": "vm.*.status"}
+//	]
+func LoadStaticAuthorizer(path string) (*StaticAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []AuthRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, r := range rules {
+		for _, a := range r.Actions {
+			if a != ActionPublish && a != ActionSubscribe {
+				return nil, fmt.Errorf("parsing %s: rule %d has unknown action %q", path, i, a)
+			}
+		}
+	}
+
+	return NewStaticAuthorizer(rules), nil
+}
+
+func (a *StaticAuthorizer) Authorize(ctx context.Context, peer Peer, action Action, channel, key string) error {
+	for _, r := range a.rules {
+		if r.allows(peer, action, channel, key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s on channel %q key %q", ErrUnauthorized, action, channel, key)
+}
+
+func (r AuthRule) allows(peer Peer, action Action, channel, key string) bool {
+	if r.Remote != uuid.Nil && r.Remote != peer.ID {
+		return false
+	}
+	if r.CommonName != "" && (peer.Certificate == nil || peer.Certificate.Subject.CommonName != r.CommonName) {
+		return false
+	}
+	if len(r.Actions) > 0 && !slices.Contains(r.Actions, action) {
+		return false
+	}
+	return match.Covers(r.Channel, channel) && (r.Key == "" || r.Key == key)
+}
+
+// Asks the authorizer whether the remote on conn may take the action, returning an error wrapping ErrUnauthorized if
+// not. Everything is allowed when the instance has no authorizer.
+func (inst *Instance) authorize(conn net.Conn, id uuid.UUID, action Action, channel, key string) error {
+	if inst.authorizer == nil {
+		return nil
+	}
+
+	peer := Peer{ID: id}
+	if c, ok := conn.(*tls.Conn); ok {
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			peer.Certificate = certs[0]
+		}
+	}
+	err := inst.authorizer.Authorize(inst.ctx, peer, action, channel, key)
+	if err != nil && !errors.Is(err, ErrUnauthorized) {
+		err = fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package tolliver
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Controls how long an instance waits before resending a reliable message which hasn't been acked. The wait after the
+// nth attempt is Initial * Multiplier^(n-1), capped at Max, and then randomly adjusted by up to Jitter in either
+// direction so that many deliveries to the same remote don't all become due at once.
+type BackoffPolicy struct {
+	// Wait after the first attempt, defaults to InstanceOptions.RetryInterval
+	Initial time.Duration
+
+	// Factor the wait grows by after each attempt, defaults to 2. Values below 1 are treated as 1.
+	Multiplier float64
+
+	// Longest wait between attempts, before jitter is applied. Defaults to 5 minutes.
+	Max time.Duration
+
+	// Fraction of the wait to randomly add or subtract, between 0 and 1. Defaults to 0.2, set a
+	// negative value to disable jitter.
+	Jitter float64
+}
+
+func (b *BackoffPolicy) populateDefaults(retryInterval time.Duration) {
+	if b.Initial == 0 {
+		b.Initial = retryInterval
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = 2
+	}
+	if b.Max == 0 {
+		b.Max = 5 * time.Minute
+	}
+	if b.Jitter == 0 {
+		b.Jitter = 0.2
+	}
+}
+
+// Returns how long to wait after the given attempt, counting from 1, before resending.
+func (b BackoffPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	wait := float64(b.Initial) * math.Pow(max(b.Multiplier, 1), float64(attempt-1))
+	if b.Max > 0 && wait > float64(b.Max) {
+		wait = float64(b.Max)
+	}
+
+	jitter := min(max(b.Jitter, 0), 1)
+	wait += wait * jitter * (rand.Float64()*2 - 1)
+
+	return time.Duration(wait)
+}
@@ -0,0 +1,277 @@
+package tolliver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Controls where the instance's certificate and CA come from and how they are kept up to date, so that short lived
+// certificates can be rotated without restarting the instance. Credentials can also be replaced at any time with
+// Instance.UpdateCredentials. New credentials are used for every TLS handshake from then on, while connections which
+// are already open keep going unless RecheckPeers is set.
+type CredentialPolicy struct {
+	// PEM files to load the instance's certificate and private key from, used instead of InstanceOptions.InstanceCert.
+	// Both or neither must be set.
+	CertFile string
+	KeyFile  string
+
+	// PEM file of the CAs to authenticate remotes with, used instead of InstanceOptions.CA
+	CAFile string
+
+	// How often to check the files for changes, reloading them when they do, and to recheck connected remotes if
+	// RecheckPeers is set. Defaults to one minute.
+	Interval time.Duration
+
+	// Closes connections to remotes whose certificate has expired or no longer verifies against the CA, such as after
+	// the CA which issued it is removed. Connections are checked every Interval and whenever the credentials change.
+	// Remotes which this instance dialed are dialed again, so they are reconnected once they present a valid
+	// certificate, while remotes which dialed this instance have to reconnect themselves.
+	RecheckPeers bool
+}
+
+func (c *CredentialPolicy) populateDefaults(opts *InstanceOptions) error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("%w: CertFile and KeyFile must be set together", InvalidInstanceOptions)
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+
+	cert, ca, err := c.load()
+	if err != nil {
+		return err
+	}
+	if cert != nil {
+		opts.InstanceCert = cert
+	}
+	if ca != nil {
+		opts.CA = ca
+	}
+	return nil
+}
+
+// Reads whichever of the certificate and CA have files set, returning nil for those which don't.
+func (c *CredentialPolicy) load() (*tls.Certificate, *x509.CertPool, error) {
+	var cert *tls.Certificate
+	if c.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = &pair
+	}
+
+	var ca *x509.CertPool
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	return cert, ca, nil
+}
+
+func (c *CredentialPolicy) files() []string {
+	var out []string
+	for _, f := range []string{c.CertFile, c.KeyFile, c.CAFile} {
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Replaces the certificate the instance presents to remotes and the CAs it authenticates them with. Either may be nil
+// to keep the current one. The new credentials are used for every TLS handshake from then on, and if
+// CredentialPolicy.RecheckPeers is set connections to remotes whose certificates no longer verify are closed.
+func (inst *Instance) UpdateCredentials(cert *tls.Certificate, ca *x509.CertPool) error {
+	inst.l.RLock()
+	closed := inst.closed
+	inst.l.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	inst.credsL.Lock()
+	if cert != nil {
+		inst.cert = cert
+	}
+	if ca != nil {
+		inst.authority = ca
+	}
+	inst.credsL.Unlock()
+
+	if inst.credentials.RecheckPeers {
+		inst.recheckPeers()
+	}
+	return nil
+}
+
+func (inst *Instance) currentCredentials() (*tls.Certificate, *x509.CertPool) {
+	inst.credsL.RLock()
+	defer inst.credsL.RUnlock()
+	return inst.cert, inst.authority
+}
+
+// The TLS config used to dial remotes, which checks that the remote's certificate is signed by the CA and valid for
+// the address's server name, or for the host being dialled if it has none.
+func (inst *Instance) clientTLSConfig(addr RemoteAddr) *tls.Config {
+	// crypto/tls leaves ConnectionState.ServerName blank when dialling an IP, so the name to check is worked out here
+	serverName := addr.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := inst.currentCredentials()
+			return cert, nil
+		},
+		// The standard verification can only use a fixed CA, so it is done in VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if inst.insecure {
+				return nil
+			}
+			return inst.verifyChain(cs.PeerCertificates, serverName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// The TLS config used to accept remotes, which requires every remote to present a certificate signed by the CA.
+func (inst *Instance) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := inst.currentCredentials()
+			return cert, nil
+		},
+		// Clients only send a certificate signed by one of the CAs the server lists, which can't change once listening,
+		// so none are listed and the certificate is verified in VerifyConnection instead
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if inst.insecure {
+				return nil
+			}
+			return inst.verifyChain(cs.PeerCertificates, "", x509.ExtKeyUsageClientAuth)
+		},
+	}
+}
+
+// Checks that a remote's certificate chains to the current CA, hasn't expired, may be used for usage and, unless
+// name is blank, is valid for name.
+func (inst *Instance) verifyChain(certs []*x509.Certificate, name string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("the remote presented no certificate")
+	}
+	_, ca := inst.currentCredentials()
+
+	opts := x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       name,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// Reloads the credential files whenever they change and, if RecheckPeers is set, rechecks the certificates of
+// connected remotes every interval.
+func (inst *Instance) watchCredentials() {
+	defer inst.wg.Done()
+	ticker := time.NewTicker(inst.credentials.Interval)
+	defer ticker.Stop()
+
+	stamps := statFiles(inst.credentials.files())
+	for {
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+		}
+
+		if current := statFiles(inst.credentials.files()); current != stamps {
+			cert, ca, err := inst.credentials.load()
+			if err != nil {
+				// The files may be part way through being replaced, so try again next time
+				inst.logger.Warn("Failed to reload credentials", "err", err)
+				continue
+			}
+			stamps = current
+			inst.logger.Info("Reloaded credentials")
+			inst.UpdateCredentials(cert, ca)
+			continue
+		}
+		if inst.credentials.RecheckPeers {
+			inst.recheckPeers()
+		}
+	}
+}
+
+// Summarises the size and modification time of each file, so that a change to any of them changes the summary.
+func statFiles(paths []string) string {
+	out := ""
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			out += fmt.Sprintf("%s:%d:%d;", p, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return out
+}
+
+// Closes the connections of remotes whose certificate no longer verifies, dialing those this instance dialed again.
+func (inst *Instance) recheckPeers() {
+	if inst.insecure {
+		return
+	}
+
+	type peer struct {
+		id   uuid.UUID
+		conn net.Conn
+	}
+	var invalid []peer
+	inst.l.RLock()
+	for id, conn := range inst.conns {
+		c, ok := conn.(*tls.Conn)
+		if !ok {
+			continue
+		}
+		// Names were checked when the connection was made and don't change, and either usage is enough to stay
+		if err := inst.verifyChain(c.ConnectionState().PeerCertificates, "", x509.ExtKeyUsageAny); err != nil {
+			inst.logger.Warn("Closing connection to remote whose certificate no longer verifies", "remote", id.String(), "err", err)
+			invalid = append(invalid, peer{id: id, conn: conn})
+		}
+	}
+	inst.l.RUnlock()
+
+	for _, p := range invalid {
+		inst.dropConn(p.id, p.conn)
+
+		inst.l.Lock()
+		addr, ok := inst.dialed[p.id]
+		if ok && !inst.closed {
+			inst.wg.Add(1)
+			go inst.keepDialing(addr, inst.retryInterval)
+		}
+		inst.l.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package tolliver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/db"
+)
+
+// Why a delivery was moved to the dead letter queue
+type DeadLetterReason string
+
+const (
+	// The recipient nacked the message
+	DeadLetterRejected DeadLetterReason = db.DeadLetterRejected
+	// The message expired before the recipient acked it
+	DeadLetterExpired DeadLetterReason = db.DeadLetterExpired
+	// The message was sent InstanceOptions.MaxAttempts times without being acked
+	DeadLetterMaxAttempts DeadLetterReason = db.DeadLetterMaxAttempts
+)
+
+var ErrDeadLetterNotFound = errors.New("No dead letter exists with the given id")
+
+// A reliable message which this instance gave up delivering to one of its recipients.
+type DeadLetter struct {
+	// Identifies the dead letter for Requeue and Purge
+	ID uint64
+
+	MessageID uint64
+	Recipient uuid.UUID
+	Channel   string
+	Key       string
+	Body      []byte
+	Headers   map[string]string
+	// Zero if the message never expires
+	ExpiresAt time.Time
+
+	Reason DeadLetterReason
+	// The reason the recipient gave when it nacked the message, empty for other reasons
+	Detail string
+	// How many times the message was sent to the recipient
+	Attempts int
+	// When the delivery was given up on
+	DeadAt time.Time
+}
+
+// Narrows the dead letters returned by Instance.DeadLetters. Zero valued fields match everything.
+type DeadLetterFilter struct {
+	Channel   string
+	Key       string
+	Recipient uuid.UUID
+	Reason    DeadLetterReason
+	// Maximum number of dead letters to return, oldest first
+	Limit int
+}
+
+// Lists the dead letters matching the filter, oldest first.
+func (inst *Instance) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	letters, err := inst.store.DeadLetters(ctx, filter)
+	if err != nil {
+		return nil, persistError(err)
+	}
+	return letters, nil
+}
+
+// Removes a dead letter and queues its message for delivery to the recipient again, starting from the first attempt.
+// Messages which had expired no longer expire for that recipient once requeued, but still expire for any others.
+func (inst *Instance) Requeue(ctx context.Context, id uint64) error {
+	found, err := inst.store.Requeue(ctx, id, time.Now())
+	if err != nil {
+		return persistError(err)
+	}
+	if !found {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// Deletes a dead letter without delivering it.
+func (inst *Instance) Purge(ctx context.Context, id uint64) error {
+	found, err := inst.store.PurgeDeadLetter(ctx, id)
+	if err != nil {
+		return persistError(err)
+	}
+	if !found {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// Reports deliveries which have just been moved to the dead letter queue.
+func (inst *Instance) deadLettered(letters []DeadLetter) {
+	for _, l := range letters {
+		inst.logger.Warn("Message moved to dead letter queue", "message", l.MessageID, "remote", l.Recipient.String(), "channel", l.Channel, "key", l.Key, "reason", l.Reason)
+		if l.Reason == DeadLetterRejected {
+			inst.resolveDelivery(l.MessageID, l.Recipient, DeliveryRejected, l.Detail)
+		} else {
+			inst.resolveDelivery(l.MessageID, l.Recipient, DeliveryDeadLettered, string(l.Reason))
+		}
+		if inst.onDeadLetter != nil {
+			inst.onDeadLetter(l)
+		}
+	}
+}
+
+// Moves deliveries which have used up InstanceOptions.MaxAttempts to the dead letter queue.
+func (inst *Instance) exhaust(now time.Time) {
+	if inst.maxAttempts <= 0 {
+		return
+	}
+
+	letters, err := inst.store.ExhaustDeliveries(inst.ctx, inst.maxAttempts, now)
+	if err != nil {
+		inst.logger.Error("Failed to dead letter exhausted deliveries", "err", err)
+		return
+	}
+	inst.deadLettered(letters)
+}
@@ -0,0 +1,76 @@
+package tolliver
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type inboxKey struct {
+	sender uuid.UUID
+	id     uint64
+}
+
+// Reports whether m is a copy of a reliable message which has already been processed, or is still being processed, when
+// deduplication is enabled. Copies of processed messages are acked again, while copies of messages still with the
+// handlers are dropped since the original will be acked once it is done.
+func (inst *Instance) duplicate(m *Message) bool {
+	if inst.dedupWindow <= 0 || !m.Reliable {
+		return false
+	}
+
+	// Claimed before checking the inbox, so that of two copies arriving at once only one gets through
+	k := inboxKey{sender: m.Sender, id: m.ID}
+	inst.l.Lock()
+	if _, busy := inst.processing[k]; busy {
+		inst.l.Unlock()
+		return true
+	}
+	if inst.processing == nil {
+		inst.processing = make(map[inboxKey]struct{})
+	}
+	inst.processing[k] = struct{}{}
+	inst.l.Unlock()
+	m.tracked = true
+
+	processed, err := inst.store.Processed(inst.ctx, m.Sender, m.ID)
+	if err != nil {
+		inst.logger.Error("Failed to check inbox", "message", m.ID, "remote", m.Sender.String(), "err", err)
+		return false
+	}
+	if processed {
+		inst.untrack(m)
+		m.tracked = false
+		if err := m.Ack(); err != nil {
+			inst.logger.Warn("Failed to send ack", "message", m.ID, "remote", m.Sender.String(), "err", err)
+		}
+		return true
+	}
+	return false
+}
+
+// Records that m was processed, so later copies of it are recognised as duplicates. Called before the ack is sent, so
+// that a copy arriving straight after can't be missed.
+func (inst *Instance) markProcessed(m *Message) {
+	if err := inst.store.MarkProcessed(inst.ctx, m.Sender, m.ID, time.Now()); err != nil {
+		inst.logger.Error("Failed to record processed message", "message", m.ID, "remote", m.Sender.String(), "err", err)
+	}
+}
+
+// Stops treating copies of m as duplicates of a message still being processed.
+func (inst *Instance) untrack(m *Message) {
+	inst.l.Lock()
+	delete(inst.processing, inboxKey{sender: m.Sender, id: m.ID})
+	inst.l.Unlock()
+}
+
+// Forgets processed messages which are older than InstanceOptions.DedupWindow.
+func (inst *Instance) pruneInbox(now time.Time) {
+	if inst.dedupWindow <= 0 {
+		return
+	}
+
+	if err := inst.store.PruneInbox(inst.ctx, now.Add(-inst.dedupWindow)); err != nil {
+		inst.logger.Error("Failed to prune inbox", "err", err)
+	}
+}
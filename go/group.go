@@ -0,0 +1,111 @@
+package tolliver
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Subscribes like Subscribe, but as a member of a queue group. Each message on the channel key pair is delivered to
+// just one member of the group rather than to every member, so several instances subscribed with the same group can
+// share out the work on a channel. Senders take turns between the members which are connected, and if the member a
+// reliable message was given to hasn't acked it by the time it is due to be resent, it is moved to another connected
+// member instead. Members may still see a message which another member has processed if an ack arrives late.
+//
+// An instance can be subscribed both by itself and in any number of groups. Retained values aren't delivered to group
+// subscriptions.
+func (inst *Instance) SubscribeGroup(ctx context.Context, channel, key, group string) error {
+	return inst.subscribe(ctx, Subscription{Channel: channel, Key: key, Group: group})
+}
+
+// Removes a subscription made with SubscribeGroup.
+func (inst *Instance) UnsubscribeGroup(ctx context.Context, channel, key, group string) error {
+	return inst.unsubscribe(ctx, Subscription{Channel: channel, Key: key, Group: group})
+}
+
+// Chooses the member of a queue group to deliver to, taking turns between the connected members other than exclude.
+// If none of them are connected one of the others is chosen, so the message waits for it until another member connects
+// and the retry loop moves it. Returns false if there is no one to choose.
+func (inst *Instance) pickMember(group string, members []uuid.UUID, exclude uuid.UUID) (uuid.UUID, bool) {
+	inst.l.Lock()
+	defer inst.l.Unlock()
+
+	var connected, others []uuid.UUID
+	for _, m := range members {
+		switch {
+		case m == exclude:
+		case inst.conns[m] != nil:
+			connected = append(connected, m)
+		default:
+			others = append(others, m)
+		}
+	}
+	candidates := connected
+	if len(candidates) == 0 {
+		candidates = others
+	}
+	if len(candidates) == 0 {
+		return uuid.Nil, false
+	}
+
+	if inst.groupTurns == nil {
+		inst.groupTurns = make(map[string]uint64)
+	}
+	turn := inst.groupTurns[group]
+	inst.groupTurns[group]++
+	return candidates[turn%uint64(len(candidates))], true
+}
+
+// Moves deliveries to queue group members which are due again, because the member didn't ack in time or isn't
+// connected, to another member of the group which is connected. Moved deliveries are due straight away, so the retry
+// loop sends them to their new member along with the sequence number it was given, and deliveries which can't be moved
+// are left for it to resend to the same member.
+func (inst *Instance) reroute(now time.Time) {
+	// Held so that a flush to the new member can't send a moved delivery at the same time as the retry loop
+	inst.attemptL.Lock()
+	defer inst.attemptL.Unlock()
+
+	due, err := inst.store.DueGroupDeliveries(inst.ctx, now)
+	if err != nil {
+		inst.logger.Error("Failed to load queue group deliveries", "err", err)
+		return
+	}
+
+	for _, v := range due {
+		inst.l.RLock()
+		connected := inst.conns[v.Recipient] != nil
+		inst.l.RUnlock()
+		if connected && v.Attempts == 0 {
+			// Not sent yet, so the member hasn't had a chance to ack it
+			continue
+		}
+
+		groups, err := inst.store.Groups(inst.ctx, v.Channel, v.Key)
+		if err != nil {
+			inst.logger.Error("Failed to load queue group members", "group", v.Group, "err", err)
+			break
+		}
+		to, ok := inst.pickMember(v.Group, groups[v.Group], v.Recipient)
+		if !ok {
+			continue
+		}
+		inst.l.RLock()
+		connected = inst.conns[to] != nil
+		inst.l.RUnlock()
+		if !connected {
+			continue
+		}
+
+		moved, err := inst.store.Reassign(inst.ctx, v.MessageID, v.Recipient, to)
+		if err != nil {
+			inst.logger.Error("Failed to move delivery to another group member", "message", v.MessageID, "group", v.Group, "err", err)
+			continue
+		}
+		if !moved {
+			continue
+		}
+		inst.logger.Debug("Moved delivery to another group member", "message", v.MessageID, "group", v.Group, "from", v.Recipient.String(), "to", to.String())
+		inst.reassignDelivery(v.MessageID, v.Recipient, to)
+	}
+}
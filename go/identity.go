@@ -0,0 +1,111 @@
+package tolliver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrIdentityMismatch = errors.New("The remote's certificate doesn't match the UUID it claimed")
+	ErrPinNotFound      = errors.New("The certificate isn't pinned for the remote")
+)
+
+// Controls which remotes may claim which UUIDs. TLS only proves that a remote holds a certificate signed by the CA, so
+// without an identity policy any such remote can claim to be another instance and be sent the messages queued for it.
+// The checks which are enabled all have to pass, and a remote which fails them has its handshake rejected. The zero
+// value enables none, trusting the UUID every remote claims.
+type IdentityPolicy struct {
+	// Requires the remote's certificate to name its UUID, either in a URI subject alternative name of the form
+	// urn:uuid:<uuid> or as the subject common name.
+	RequireCertificateID bool
+
+	// Requires the remote's certificate to have been pinned for its UUID with Instance.PinCertificate. Several
+	// certificates can be pinned for the same UUID, so a new one can be pinned before a remote switches to it.
+	RequirePinned bool
+
+	// Called with the UUID a remote claims and the certificate it presented, rejecting the remote if it returns an
+	// error.
+	Verify func(id uuid.UUID, cert *x509.Certificate) error
+}
+
+// SHA-256 hash of a DER encoded certificate
+type Fingerprint [sha256.Size]byte
+
+func CertificateFingerprint(cert *x509.Certificate) Fingerprint {
+	return sha256.Sum256(cert.Raw)
+}
+
+func (f Fingerprint) String() string {
+	return fmt.Sprintf("%x", f[:])
+}
+
+// Allows the remote with the given UUID to present the certificate with the fingerprint, for when
+// IdentityPolicy.RequirePinned is set. Pinning a certificate which is already pinned does nothing.
+func (inst *Instance) PinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) error {
+	if err := inst.store.PinCertificate(ctx, remote, fingerprint); err != nil {
+		return persistError(err)
+	}
+	return nil
+}
+
+// Stops the remote with the given UUID from presenting the certificate with the fingerprint. Connections which are
+// already open are left alone.
+func (inst *Instance) UnpinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) error {
+	found, err := inst.store.UnpinCertificate(ctx, remote, fingerprint)
+	if err != nil {
+		return persistError(err)
+	}
+	if !found {
+		return ErrPinNotFound
+	}
+	return nil
+}
+
+// Checks the UUID a remote claimed in its handshake against the certificate it presented on conn.
+func (inst *Instance) verifyIdentity(ctx context.Context, conn *tls.Conn, id uuid.UUID) error {
+	p := inst.identity
+	if !p.RequireCertificateID && !p.RequirePinned && p.Verify == nil {
+		return nil
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%w: no certificate was presented", ErrIdentityMismatch)
+	}
+	cert := certs[0]
+
+	if p.RequireCertificateID && !certificateNames(cert, id) {
+		return fmt.Errorf("%w: %s isn't named in the certificate for %q", ErrIdentityMismatch, id, cert.Subject.CommonName)
+	}
+	if p.RequirePinned {
+		pinned, err := inst.store.CertificatePinned(ctx, id, CertificateFingerprint(cert))
+		if err != nil {
+			return persistError(err)
+		}
+		if !pinned {
+			return fmt.Errorf("%w: certificate %s isn't pinned for %s", ErrIdentityMismatch, CertificateFingerprint(cert), id)
+		}
+	}
+	if p.Verify != nil {
+		if err := p.Verify(id, cert); err != nil {
+			return fmt.Errorf("%w: %w", ErrIdentityMismatch, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether the certificate names the UUID in a urn:uuid URI or as its common name.
+func certificateNames(cert *x509.Certificate, id uuid.UUID) bool {
+	for _, u := range cert.URIs {
+		if u.Scheme == "urn" && strings.EqualFold(u.Opaque, "uuid:"+id.String()) {
+			return true
+		}
+	}
+	return strings.EqualFold(cert.Subject.CommonName, id.String())
+}
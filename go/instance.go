@@ -1,12 +1,16 @@
 package tolliver
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,20 +18,67 @@ import (
 	"github.com/tug-dev/tolliver/go/internal/binary"
 	"github.com/tug-dev/tolliver/go/internal/common"
 	"github.com/tug-dev/tolliver/go/internal/connections"
-	"github.com/tug-dev/tolliver/go/internal/db"
 	"github.com/tug-dev/tolliver/go/internal/handshake"
+	"github.com/tug-dev/tolliver/go/internal/match"
 )
 
 type Instance struct {
-	certs     []tls.Certificate
-	authority *x509.CertPool
-	subs      []common.SubcriptionInfo
-	id        uuid.UUID
-	conns     map[uuid.UUID]net.Conn
-	callbacks map[*common.SubcriptionInfo][]func([]byte) bool
-	db        *sql.DB
+	// The certificate and CA currently in use, which UpdateCredentials can replace while the instance is running
+	credsL       sync.RWMutex
+	cert         *tls.Certificate
+	authority    *x509.CertPool
+	credentials  CredentialPolicy
+	insecure     bool
+	identity     IdentityPolicy
+	authorizer   Authorizer
+	subs         []common.SubcriptionInfo
+	id           uuid.UUID
+	conns        map[uuid.UUID]net.Conn
+	handlers     []handlerEntry
+	handlerIndex match.Trie[int]
+	receipts     map[uint64]*pendingReceipt
+	groupTurns   map[string]uint64
+	requests     map[string]chan *Message
+	streams      map[streamKey]*orderedStream
+	processing   map[inboxKey]struct{}
+	dedupWindow  time.Duration
+	orderL       sync.Mutex
+	onRejected   func(Rejection)
+	onExpired    func(Expiry)
+	onDeadLetter func(DeadLetter)
+	maxAttempts  int
+	backoff      BackoffPolicy
+	retention    RetentionPolicy
+	// Connections accepted from remotes which haven't finished their handshake yet, closed by Close along with conns
+	handshaking      map[net.Conn]struct{}
+	handshakeTimeout time.Duration
+	// Addresses this instance dialed remotes at, used to dial them again after dropping their connection
+	dialed        map[uuid.UUID]RemoteAddr
+	retryInterval time.Duration
+	// What the store held when it was last measured, plus messages saved since
+	usage StoreUsage
+	// Read locked from reserving space for a message until it is saved, and locked while measuring the store, so a
+	// measurement never drops the reservation of a message which is still being saved
+	quotaL sync.RWMutex
+	// Held from finding a delivery to send until its attempt is recorded, so Send, flush and the retry loop never send
+	// the same attempt twice
+	attemptL  sync.Mutex
+	store     Store
+	ownsStore bool
 	l         sync.RWMutex
 	logger    slog.Logger
+
+	// Used for work the instance does in the background, cancelled by Close once draining is finished
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed by Close to tell the background goroutines to exit
+	done     chan struct{}
+	closed   bool
+	listener net.Listener
+	// Tracks the retry loop, the garbage collector, the accept loop and the per connection read loops
+	wg sync.WaitGroup
+	// Tracks callbacks which are currently processing a message
+	inflight sync.WaitGroup
 }
 
 type DialError struct {
@@ -54,79 +105,256 @@ const (
 const (
 	AckSuccess byte = iota
 	AckError
+	// The receiver's Authorizer doesn't allow the sender to send the message
+	AckDenied
 )
 
 const ReservedTolliverChannel = "tolliver"
 
-var ErrConnAlreadyExists = errors.New("This instance already has a connection to the requested remote address")
+var (
+	ErrConnAlreadyExists = errors.New("This instance already has a connection to the requested remote address")
+	ErrClosed            = errors.New("The instance has been closed")
+	ErrReservedChannel   = errors.New("The tolliver channel is reserved for protocol messages")
+	ErrChannelPattern    = errors.New("Messages can't be sent on a channel containing wildcards")
+	ErrNotConnected      = errors.New("A subscribed remote is not currently connected")
+	ErrPersistFailed     = errors.New("Failed to persist to the database")
+	ErrTxUnsupported     = errors.New("The store can't save messages inside a SQL transaction")
+
+	errMalformedMessage = errors.New("Malformed protocol message")
+)
+
+// Checks that application messages may be sent on the channel.
+func checkSendChannel(channel string) error {
+	if channel == ReservedTolliverChannel {
+		return ErrReservedChannel
+	}
+	if match.IsPattern(channel) {
+		return ErrChannelPattern
+	}
+	return nil
+}
+
+func persistError(err error) error {
+	return fmt.Errorf("%w: %w", ErrPersistFailed, err)
+}
+
+// Returns the UUID this instance identifies itself with to remotes, which is persisted in the database.
+func (inst *Instance) ID() uuid.UUID {
+	return inst.id
+}
 
 // Attempts to create a tolliver connection to the provided address by opening a TCP socket, performing a TLS handshake
-// and then a tolliver handshake
-func (inst *Instance) NewConnection(addr RemoteAddr) {
-	go inst.newConnection(addr)
+// and then a tolliver handshake. A failure to dial or handshake is returned as a *DialError, and ErrConnAlreadyExists is
+// returned if this instance is already connected to the remote's UUID. The context bounds the whole connection attempt
+// but not the lifetime of the resulting connection.
+func (inst *Instance) NewConnection(ctx context.Context, addr RemoteAddr) error {
+	inst.l.RLock()
+	closed := inst.closed
+	inst.l.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	dialer := tls.Dialer{Config: inst.clientTLSConfig(addr)}
+	c, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return &DialError{addr: addr, err: err}
+	}
+	conn := c.(*tls.Conn)
+
+	// Abort the handshake if the context is done before it completes
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	r := binary.NewReader(conn)
+	remId, remSubs, err := handshake.SendTolliverHandshake(conn, r, inst.id, inst.subscriptions(), func(id uuid.UUID) error {
+		return inst.verifyIdentity(ctx, conn, id)
+	})
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return &DialError{addr: addr, err: err}
+	}
+
+	if err := inst.addConn(ctx, conn, r, remId, remSubs); err != nil {
+		return err
+	}
+	inst.l.Lock()
+	inst.dialed[remId] = addr
+	inst.l.Unlock()
+	return nil
 }
 
-func (inst *Instance) newConnection(addr RemoteAddr) {
+// Tries to connect to addr every interval until it succeeds or the instance is closed. This is used for the remotes
+// passed in InstanceOptions, which may not be reachable yet when the instance is created.
+func (inst *Instance) keepDialing(addr RemoteAddr, interval time.Duration) {
+	defer inst.wg.Done()
+
 	for {
-		opts := &tls.Config{Certificates: inst.certs, RootCAs: inst.authority, ServerName: addr.ServerName, InsecureSkipVerify: true}
-		conn, err := tls.Dial("tcp", addr.String(), opts)
-		if err != nil {
-			inst.logger.Error("Failed to connect to " + addr.Addr.String())
-			continue
+		ctx, cancel := context.WithTimeout(context.Background(), inst.handshakeTimeout)
+		err := inst.NewConnection(ctx, addr)
+		cancel()
+		if err == nil || errors.Is(err, ErrClosed) || errors.Is(err, ErrConnAlreadyExists) {
+			return
 		}
+		inst.logger.Error("Failed to connect to remote", "addr", addr.String(), "err", err)
 
-		remId, remSubs, err := handshake.SendTolliverHandshake(conn, inst.id, inst.subs)
-		if err != nil {
-			inst.logger.Error("Tolliver handshake with " + addr.Addr.String() + " failed - " + err.Error())
-			continue
+		select {
+		case <-inst.done:
+			return
+		case <-time.After(interval):
 		}
+	}
+}
 
-		inst.l.RLock()
-		if inst.conns[remId] != nil {
-			return
+// Records the subscriptions a remote sent during the handshake and starts reading messages from the connection.
+func (inst *Instance) addConn(ctx context.Context, conn net.Conn, r *binary.Reader, remId uuid.UUID, remSubs []common.SubcriptionInfo) error {
+	remSubs = slices.DeleteFunc(remSubs, func(s common.SubcriptionInfo) bool {
+		err := inst.authorize(conn, remId, ActionSubscribe, s.Channel, s.Key)
+		if err != nil {
+			inst.logger.Warn("Ignored subscription from handshake", "remote", remId.String(), "channel", s.Channel, "key", s.Key, "err", err)
 		}
-		inst.l.RUnlock()
+		return err != nil
+	})
+
+	inst.l.Lock()
+	defer inst.l.Unlock()
+
+	if inst.closed {
+		conn.Close()
+		return ErrClosed
+	}
+	if inst.conns[remId] != nil {
+		conn.Close()
+		return ErrConnAlreadyExists
+	}
+
+	// The remote's handshake lists everything it is subscribed to, so it replaces whatever was remembered from the last
+	// connection. Subscriptions are kept after a disconnect so messages for the remote queue up until it reconnects.
+	// Every remote receives protocol messages, which are sent on the reserved channel.
+	subs := append(fromSubscriptionInfos(remSubs), Subscription{Channel: ReservedTolliverChannel})
+	if err := inst.store.ReplaceSubscriptions(ctx, remId, subs); err != nil {
+		conn.Close()
+		return persistError(err)
+	}
 
-		for _, s := range remSubs {
-			db.Subscribe(s.Channel, s.Key, remId, inst.db)
+	for _, s := range remSubs {
+		if s.Group == "" {
+			inst.deliverRetained(remId, s.Channel, s.Key)
 		}
+	}
 
-		inst.l.Lock()
-		inst.conns[remId] = conn
-		inst.l.Unlock()
-		go inst.handleConn(binary.NewReader(conn), conn, remId)
+	inst.conns[remId] = conn
+	inst.wg.Add(2)
+	go inst.handleConn(r, conn, remId)
+	go inst.flush(remId, conn)
+
+	return nil
+}
+
+// Sends every reliable message still waiting to be delivered to a remote which has just connected, rather than leaving
+// them until the retry loop next finds them due.
+func (inst *Instance) flush(remId uuid.UUID, conn net.Conn) {
+	defer inst.wg.Done()
+
+	inst.attemptL.Lock()
+	deliveries, err := inst.store.PendingDeliveries(inst.ctx, remId)
+	if err != nil {
+		inst.attemptL.Unlock()
+		inst.logger.Error("Failed to load undelivered messages", "remote", remId.String(), "err", err)
 		return
 	}
+	now := time.Now()
+	deliveries = slices.DeleteFunc(deliveries, func(v StoredDelivery) bool {
+		// Left for the retry loop to dead letter
+		return (!v.ExpiresAt.IsZero() && now.After(v.ExpiresAt)) || (inst.maxAttempts > 0 && v.Attempts >= inst.maxAttempts)
+	})
+	for _, v := range deliveries {
+		inst.recordAttempt(v.MessageID, remId, now, v.Attempts+1)
+	}
+	inst.attemptL.Unlock()
+
+	for _, v := range deliveries {
+		if err := connections.SendBytes(buildMes(v.Body, v.MessageID, v.Channel, v.Key, inst.deliveryHeaders(v)), conn); err != nil {
+			inst.logger.Warn("Failed to flush undelivered messages", "remote", remId.String(), "err", err)
+			return
+		}
+	}
 }
 
 // Notifies all instances this instance is currently conencted to that this instance wants to receive messages
-// on the provided channel and key. This is stored in memory so it can be sent during handshakes, however it is
-// not persisted to the database.
+// on the provided channel and key. The subscription is saved to the database, so it is restored when the instance is
+// next created and sent to every remote during the handshake until Unsubscribe is called. Subscribing to a pair this
+// instance is already subscribed to does nothing.
 //
-// Passing a blank string for either channel or key acts like a * wildcard, i.e this instance will receive messages
-// regardless of the destination channel, key or both
-func (inst *Instance) Subscribe(channel, key string) {
-	if channel == ReservedTolliverChannel {
-		panic("The tolliver channel is reserved for protocol messages")
+// Passing a blank string for either channel or key acts like a wildcard, i.e this instance will receive messages
+// regardless of the destination channel, key or both. The channel may also be a pattern such as "vm.*.shutdown" or
+// "vm.>", matched as described by MatchChannel.
+func (inst *Instance) Subscribe(ctx context.Context, channel, key string) error {
+	return inst.subscribe(ctx, Subscription{Channel: channel, Key: key})
+}
+
+func (inst *Instance) subscribe(ctx context.Context, sub Subscription) error {
+	if sub.Channel == ReservedTolliverChannel {
+		return ErrReservedChannel
+	}
+
+	inst.l.Lock()
+	added, err := inst.store.AddLocalSubscription(ctx, sub)
+	if err != nil {
+		inst.l.Unlock()
+		return persistError(err)
+	}
+	if added {
+		inst.subs = append(inst.subs, toSubscriptionInfo(sub))
 	}
+	inst.l.Unlock()
+
+	if !added {
+		return nil
+	}
+	return inst.send(ctx, buildSub(toSubscriptionInfo(sub)), ReservedTolliverChannel, "", true, sendOptions{})
+}
 
-	inst.subs = append(inst.subs, common.SubcriptionInfo{Channel: channel, Key: key})
-	inst.send(buildSub(channel, key), ReservedTolliverChannel, "", true)
+// Subscribes like Subscribe, and also asks every remote to resend the messages it still holds on the channel key pair
+// which it sent at or after since. Remotes only hold on to messages for as long as their RetentionPolicy says, so
+// channels which need to be replayed should be given a retention period through RetentionPolicy.Channels on the
+// instances which publish to them. Remotes which aren't connected receive the request once they reconnect.
+//
+// Replayed messages are delivered reliably with their original ids, so a receiver with deduplication enabled drops
+// any it has already processed within its DedupWindow.
+func (inst *Instance) SubscribeFrom(ctx context.Context, channel, key string, since time.Time) error {
+	if err := inst.Subscribe(ctx, channel, key); err != nil {
+		return err
+	}
+	return inst.send(ctx, buildReplay(channel, key, since), ReservedTolliverChannel, "", true, sendOptions{})
 }
 
 // Publishses to all conencted nodes that this node no longer wishes to receive messages on a given key channel pair.
-// If the provided key channel pair was in the nodes subscriptions list locally it will be removed and no longer sent to
-// new connections during the handshake.
+// If the provided key channel pair was in the nodes subscriptions list it will be removed from it and from the
+// database, and no longer sent to new connections during the handshake.
 //
 // TODO: do we want to change the behaviour such that passing blank strings here unsubscribes from all relevant channels.
-func (inst *Instance) Unsubscribe(channel, key string) {
-	if channel == ReservedTolliverChannel {
-		panic("Cannot unsubscribe from the reserved tolliver channel")
+func (inst *Instance) Unsubscribe(ctx context.Context, channel, key string) error {
+	return inst.unsubscribe(ctx, Subscription{Channel: channel, Key: key})
+}
+
+func (inst *Instance) unsubscribe(ctx context.Context, sub Subscription) error {
+	if sub.Channel == ReservedTolliverChannel {
+		return ErrReservedChannel
+	}
+
+	inst.l.Lock()
+	if err := inst.store.RemoveLocalSubscription(ctx, sub); err != nil {
+		inst.l.Unlock()
+		return persistError(err)
 	}
 
 	idx := -1
 	for i, v := range inst.subs {
-		if v.Channel == channel && v.Key == key {
+		if v == toSubscriptionInfo(sub) {
 			idx = i
 			break
 		}
@@ -136,93 +364,295 @@ func (inst *Instance) Unsubscribe(channel, key string) {
 		inst.subs[idx] = inst.subs[len(inst.subs)-1]
 		inst.subs = inst.subs[:len(inst.subs)-1]
 	}
+	inst.l.Unlock()
 
-	inst.send(buildUnSub(channel, key), ReservedTolliverChannel, "", true)
+	return inst.send(ctx, buildUnSub(toSubscriptionInfo(sub)), ReservedTolliverChannel, "", true, sendOptions{})
+}
+
+func (inst *Instance) subscriptions() []common.SubcriptionInfo {
+	inst.l.RLock()
+	defer inst.l.RUnlock()
+
+	return append([]common.SubcriptionInfo(nil), inst.subs...)
 }
 
 // Registers a callback on the given key channel pair. This function will be called by tolliver any time a message is
 // received on that pair. As is the case with the Subscribe method, passing blank strings for key or channel to this
-// behaves like a wildcard. The callback should return a boolean value which indicates whether the message has been
-// processed correctly and should be acked
-func (inst *Instance) Register(channel, key string, cb func([]byte) bool) {
-	if inst.callbacks == nil {
-		inst.callbacks = make(map[*common.SubcriptionInfo][]func([]byte) bool)
+// behaves like a wildcard, and the channel may be a pattern. The callback should return a boolean value which
+// indicates whether the message has been processed correctly and should be acked
+//
+// This is a shorthand for RegisterHandler for callbacks which only need the message body.
+func (inst *Instance) Register(channel, key string, cb func([]byte) bool) error {
+	return inst.RegisterHandler(channel, key, func(ctx context.Context, m *Message) error {
+		if !cb(m.Body) {
+			return errNotProcessed
+		}
+		return nil
+	})
+}
+
+// Registers a handler on the given key channel pair, which will be called with every message received on that pair
+// along with its metadata. Blank strings for key or channel and channel patterns behave as with Register. The context
+// passed to the handler is cancelled when the instance is closed.
+func (inst *Instance) RegisterHandler(channel, key string, h Handler) error {
+	if channel == ReservedTolliverChannel {
+		return ErrReservedChannel
 	}
 
-	w := &common.SubcriptionInfo{Channel: channel, Key: key}
+	inst.l.Lock()
+	defer inst.l.Unlock()
+
+	inst.handlerIndex.Add(channel, len(inst.handlers))
+	inst.handlers = append(inst.handlers, handlerEntry{channel: channel, key: key, handler: h})
+	return nil
+}
 
-	if inst.callbacks[w] == nil {
-		inst.callbacks[w] = make([]func([]byte) bool, 0, 5)
+// Sends a message to all instances which are currently connected and subscribed on the channel key pair. Saves the message and
+// required metadata to ensure eventual delivery. An error wrapping ErrPersistFailed is returned if the message could
+// not be saved, in which case it will not be delivered.
+func (inst *Instance) Send(ctx context.Context, channel, key string, mes []byte, opts ...SendOption) error {
+	if err := checkSendChannel(channel); err != nil {
+		return err
+	}
+
+	o, err := buildSendOptions(opts)
+	if err != nil {
+		return err
 	}
 
-	inst.callbacks[w] = append(inst.callbacks[w], cb)
+	return inst.send(ctx, mes, channel, key, true, o)
 }
 
-// Sends a message to all instances which are currently connected and subscribed on the channel key pair. Saves the message and
-// required metadata to ensure eventual delivery.
-func (inst *Instance) Send(channel, key string, mes []byte) {
-	inst.send(mes, channel, key, true)
+// Sends a message reliably like Send. Intended for status-like channels published with Retain, so that every remote
+// which subscribes to the channel key pair, now or later, receives the latest value.
+func (inst *Instance) Publish(ctx context.Context, channel, key string, mes []byte, opts ...SendOption) error {
+	return inst.Send(ctx, channel, key, mes, opts...)
 }
 
-// Attempts once to send a message to all connected instances subscribed to the key channel pair.
-func (inst *Instance) UnreliableSend(channel, key string, mes []byte) {
-	inst.send(mes, channel, key, false)
+// Saves a reliable message as part of tx, so that it is only sent if tx commits and is never lost if it does. The
+// instance must have been created with InstanceOptions.Database set to the database tx belongs to, or with a Store
+// implementing TxStore which uses that database, otherwise ErrTxUnsupported is returned. The message is
+// addressed to the remotes subscribed on the channel key pair when SendTx is called, and is sent by the retry loop
+// within a RetryInterval of tx committing. An error wrapping ErrPersistFailed is returned if the message could not be
+// saved, in which case the caller should roll tx back.
+func (inst *Instance) SendTx(ctx context.Context, tx *sql.Tx, channel, key string, mes []byte, opts ...SendOption) error {
+	if err := checkSendChannel(channel); err != nil {
+		return err
+	}
+
+	o, err := buildSendOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	inst.l.RLock()
+	closed := inst.closed
+	inst.l.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	store, ok := inst.store.(TxStore)
+	if !ok {
+		return ErrTxUnsupported
+	}
+	_, recipients, err := inst.findRecipients(ctx, channel, key)
+	if err != nil {
+		return persistError(err)
+	}
+	if err := inst.reserve(channel, len(mes)); err != nil {
+		return err
+	}
+	_, err = store.SaveMessageTx(ctx, tx, StoredMessage{Channel: channel, Key: key, Body: mes, Headers: o.headers, ExpiresAt: o.expiresAt, Ordered: o.ordered, SavedAt: time.Now(), Retain: o.retain}, recipients)
+	if err != nil {
+		return persistError(err)
+	}
+
+	return nil
+}
+
+// Attempts once to send a message to all connected instances subscribed to the key channel pair. Returns an error
+// wrapping ErrNotConnected if any subscribed instance is not currently connected, since the message will never reach it.
+func (inst *Instance) UnreliableSend(ctx context.Context, channel, key string, mes []byte, opts ...SendOption) error {
+	if err := checkSendChannel(channel); err != nil {
+		return err
+	}
+
+	o, err := buildSendOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	return inst.send(ctx, mes, channel, key, false, o)
 }
 
 // INFO: Personally I think with a sensible retry interval (10seconds +) we shouldn't need to worry about immediate resends being, and multiple deliveries is assumed by users.
 func (inst *Instance) retry(interval time.Duration) {
+	defer inst.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		time.Sleep(interval)
-		notAcked := db.GetWork(inst.db)
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+		}
 
 		inst.l.RLock()
+		connected := make([]uuid.UUID, 0, len(inst.conns))
+		for id := range inst.conns {
+			connected = append(connected, id)
+		}
+		inst.l.RUnlock()
+
+		now := time.Now()
+		inst.expire(now)
+		inst.exhaust(now)
+		inst.pruneInbox(now)
+		inst.reroute(now)
+
+		// Deliveries to remotes which aren't connected are left due, so they are sent as soon as the remote reconnects
+		inst.attemptL.Lock()
+		notAcked, err := inst.store.DueDeliveries(inst.ctx, now, connected)
+		if err != nil {
+			inst.attemptL.Unlock()
+			inst.logger.Error("Failed to load unacked deliveries", "err", err)
+			continue
+		}
+		type resend struct {
+			v StoredDelivery
+			c net.Conn
+		}
+		var resends []resend
 		for _, v := range notAcked {
-			if c := inst.conns[v.Receiver]; c != nil {
-				connections.SendBytes(buildMes(v.Payload, v.MesId, v.Channel, v.Key), c)
+			inst.l.RLock()
+			c := inst.conns[v.Recipient]
+			inst.l.RUnlock()
+			if c == nil {
+				continue
 			}
+
+			inst.recordAttempt(v.MessageID, v.Recipient, now, v.Attempts+1)
+			resends = append(resends, resend{v: v, c: c})
+		}
+		inst.attemptL.Unlock()
+
+		for _, r := range resends {
+			connections.SendBytes(buildMes(r.v.Body, r.v.MessageID, r.v.Channel, r.v.Key, inst.deliveryHeaders(r.v)), r.c)
 		}
-		inst.l.RUnlock()
+	}
+}
+
+// Moves deliveries of messages which expired before being acked to the dead letter queue, reporting each one.
+func (inst *Instance) expire(now time.Time) {
+	expired, err := inst.store.ExpireDeliveries(inst.ctx, now)
+	if err != nil {
+		inst.logger.Error("Failed to expire deliveries", "err", err)
+		return
+	}
+
+	inst.deadLettered(expired)
+	if inst.onExpired != nil {
+		for _, v := range expired {
+			inst.onExpired(Expiry{Recipient: v.Recipient, MessageID: v.MessageID, Channel: v.Channel, Key: v.Key, ExpiredAt: v.ExpiresAt})
+		}
+	}
+}
+
+// Returns the headers to send a saved delivery with, including where its ordered stream starts if it has a sequence
+// number.
+func (inst *Instance) deliveryHeaders(v StoredDelivery) map[string]string {
+	return wireHeaders(v.Headers, v.ExpiresAt, v.Seq, inst.firstPending(v.Channel, v.Key, v.Recipient, v.Seq))
+}
+
+// Looks up the lowest sequence number still to be delivered to recipient on the channel key pair, for sending along
+// with the ordered message seq. Returns 0, which tells the recipient nothing, if seq is 0 or the lookup fails.
+func (inst *Instance) firstPending(channel, key string, recipient uuid.UUID, seq uint64) uint64 {
+	if seq == 0 {
+		return 0
+	}
+
+	first, err := inst.store.FirstPendingSeq(inst.ctx, channel, key, recipient)
+	if err != nil {
+		inst.logger.Error("Failed to load the start of an ordered stream", "channel", channel, "key", key, "remote", recipient.String(), "err", err)
+		return 0
+	}
+	return first
+}
+
+// Schedules the next resend of a delivery according to the backoff policy.
+func (inst *Instance) recordAttempt(mesId uint64, recipient uuid.UUID, at time.Time, attempt int) {
+	next := at.Add(inst.backoff.Delay(attempt))
+	if err := inst.store.RecordAttempt(inst.ctx, mesId, recipient, at, next); err != nil {
+		inst.logger.Error("Failed to record delivery attempt", "message", mesId, "remote", recipient.String(), "err", err)
 	}
 }
 
 func (inst *Instance) listenOn(laddr string) error {
-	opts := &tls.Config{Certificates: inst.certs, RootCAs: inst.authority, InsecureSkipVerify: true}
-	lst, err := tls.Listen("tcp", laddr, opts)
+	lst, err := tls.Listen("tcp", laddr, inst.serverTLSConfig())
 	if err != nil {
 		return err
 	}
 
-	go connections.HandleListener(lst, inst.awaitHandshake)
+	inst.listener = lst
+	inst.wg.Add(1)
+	go func() {
+		defer inst.wg.Done()
+		connections.HandleListener(lst, func(conn net.Conn) {
+			// Each handshake gets its own goroutine so that a remote which never completes one doesn't hold up the rest
+			inst.wg.Add(1)
+			go inst.awaitHandshake(conn)
+		})
+	}()
 
-	return err
+	return nil
 }
 
 func (inst *Instance) awaitHandshake(conn net.Conn) {
-	remId, remSubs, err := handshake.AwaitHandshake(conn, inst.id, inst.subs)
-	if err != nil {
+	defer inst.wg.Done()
+
+	inst.l.Lock()
+	if inst.closed {
+		inst.l.Unlock()
+		conn.Close()
 		return
 	}
+	inst.handshaking[conn] = struct{}{}
+	inst.l.Unlock()
+
+	conn.SetDeadline(time.Now().Add(inst.handshakeTimeout))
+	r := binary.NewReader(conn)
+	remId, remSubs, err := handshake.AwaitHandshake(conn, r, inst.id, inst.subscriptions(), func(id uuid.UUID) error {
+		return inst.verifyIdentity(inst.ctx, conn.(*tls.Conn), id)
+	})
+	conn.SetDeadline(time.Time{})
 
-	// TODO: How do we want to handle this. Could overwrite existing conn / have slice of conns and send to all. (Same issue as when creating connection)
 	inst.l.Lock()
-	if inst.conns[remId] != nil {
+	delete(inst.handshaking, conn)
+	inst.l.Unlock()
+	if err != nil {
+		inst.logger.Warn("Tolliver handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
 		return
 	}
 
-	for _, s := range remSubs {
-		db.Subscribe(s.Channel, s.Key, remId, inst.db)
+	// TODO: How do we want to handle this. Could overwrite existing conn / have slice of conns and send to all. (Same issue as when creating connection)
+	if err := inst.addConn(inst.ctx, conn, r, remId, remSubs); err != nil {
+		inst.logger.Warn("Rejected connection", "remote", conn.RemoteAddr().String(), "err", err)
 	}
-	inst.conns[remId] = conn
-
-	inst.l.Unlock()
-	go inst.handleConn(binary.NewReader(conn), conn, remId)
 }
 
+// Reads messages from conn until it errors or is closed, at which point the connection is forgotten so that a new one
+// can be made to the same remote.
 func (inst *Instance) handleConn(r *binary.Reader, conn net.Conn, id uuid.UUID) {
+	defer inst.wg.Done()
+	defer inst.dropConn(id, conn)
+
 	for {
 		mesType, err := r.ReadByte()
 		if err != nil {
-			continue
+			return
 		}
 
 		switch mesType {
@@ -242,18 +672,47 @@ func (inst *Instance) handleConn(r *binary.Reader, conn net.Conn, id uuid.UUID)
 	}
 }
 
+func (inst *Instance) dropConn(id uuid.UUID, conn net.Conn) {
+	inst.l.Lock()
+	if inst.conns[id] == conn {
+		delete(inst.conns, id)
+	}
+	inst.l.Unlock()
+	conn.Close()
+}
+
 func (inst *Instance) proccessAck(r *binary.Reader, id uuid.UUID) {
 	var status byte
-	var mesId uint64
-	err := r.ReadAll(nil, &status, &mesId)
+	var mesId, reasonLen uint64
+	err := r.ReadAll(nil, &status, &mesId, &reasonLen)
+	if err != nil {
+		return
+	}
+	reason, err := r.ReadString(reasonLen)
 	if err != nil {
 		return
 	}
-	if status != AckSuccess || mesId == 0 {
+	if mesId == 0 || (status != AckSuccess && status != AckError && status != AckDenied) {
+		return
+	}
+
+	if status == AckSuccess {
+		if err := inst.store.Ack(inst.ctx, mesId, id); err != nil {
+			inst.logger.Error("Failed to record ack", "message", mesId, "remote", id.String(), "err", err)
+		}
+		inst.resolveDelivery(mesId, id, DeliveryAcked, "")
 		return
 	}
 
-	db.Ack(mesId, id, inst.db)
+	// A nack is final, so the delivery is moved to the dead letter queue rather than retried
+	letters, err := inst.store.Reject(inst.ctx, mesId, id, reason, time.Now())
+	if err != nil {
+		inst.logger.Error("Failed to record nack", "message", mesId, "remote", id.String(), "err", err)
+	}
+	inst.deadLettered(letters)
+	if inst.onRejected != nil {
+		inst.onRejected(Rejection{Recipient: id, MessageID: mesId, Reason: reason, Denied: status == AckDenied})
+	}
 }
 
 func (inst *Instance) processRegularMessage(r *binary.Reader, conn net.Conn, id uuid.UUID) {
@@ -274,6 +733,10 @@ func (inst *Instance) processRegularMessage(r *binary.Reader, conn net.Conn, id
 	if err != nil {
 		return
 	}
+	var headers map[string]string
+	if err := r.ReadHeaders(&headers); err != nil {
+		return
+	}
 	bodyLen, err := r.ReadUint64()
 	if err != nil {
 		return
@@ -283,109 +746,300 @@ func (inst *Instance) processRegularMessage(r *binary.Reader, conn net.Conn, id
 		return
 	}
 
-	var shouldAck = true
-
-	var shouldAck = true
-
 	if channel == ReservedTolliverChannel {
-		inst.systemMessage(r, id, bodyLen)
-	} else {
-		body := make([]byte, int(bodyLen))
-		r.FillBuf(body)
+		err := inst.systemMessage(r, conn, id, bodyLen)
+		// 0 is the message ID for unreliable messages
+		if mesId == 0 {
+			return
+		}
+		if err == nil {
+			connections.SendBytes(buildAck(AckSuccess, mesId, ""), conn)
+		} else if errors.Is(err, ErrUnauthorized) {
+			connections.SendBytes(buildAck(AckDenied, mesId, err.Error()), conn)
+		}
+		return
+	}
 
-		inst.l.RLock()
-		for k, v := range inst.callbacks {
-			if (k.Channel == channel || k.Channel == "") && (k.Key == key || k.Key == "") {
-				for _, cb := range v {
-					shouldAck = shouldAck && cb(body)
-				}
+	body := make([]byte, int(bodyLen))
+	if err := r.FillBuf(body); err != nil {
+		return
+	}
+
+	// Replies only ever go to the Request call waiting for them, so there is nothing to protect
+	if _, reply := headers[replyToHeader]; !reply {
+		if err := inst.authorize(conn, id, ActionPublish, channel, key); err != nil {
+			inst.logger.Warn("Dropped message the remote isn't allowed to send", "remote", id.String(), "channel", channel, "key", key, "err", err)
+			if mesId != 0 {
+				connections.SendBytes(buildAck(AckDenied, mesId, err.Error()), conn)
 			}
+			return
 		}
-		inst.l.RUnlock()
 	}
 
-	// 0 is the message ID for unreliable messages
-	if mesId != 0 && shouldAck {
-		ack := buildAck(AckSuccess, mesId)
-		connections.SendBytes(ack, conn)
-	}
+	inst.dispatch(&Message{
+		Channel:    channel,
+		Key:        key,
+		Body:       body,
+		Sender:     id,
+		ID:         mesId,
+		Reliable:   mesId != 0,
+		ReceivedAt: time.Now(),
+		Headers:    headers,
+		conn:       conn,
+	})
 }
 
-func buildAck(status byte, id uint64) []byte {
+func buildAck(status byte, id uint64, reason string) []byte {
 	w := binary.NewWriter()
-	w.WriteAll(byte(4), status, id)
+	w.WriteAll(byte(4), status, id, uint64(len(reason)), reason)
 	return w.Join()
 }
 
-func (inst *Instance) systemMessage(r *binary.Reader, id uuid.UUID, expectedLength uint64) {
+// Applies a subscription, unsubscription or replay message from a remote. Returns nil if it was processed and should be
+// acked, an error wrapping ErrUnauthorized if the remote isn't allowed to send it, and any other error if it couldn't
+// be processed.
+func (inst *Instance) systemMessage(r *binary.Reader, conn net.Conn, id uuid.UUID, expectedLength uint64) error {
 	code, err := r.ReadByte()
-	if err != nil || !(code == 0 || code == 1) {
-		return
+	if err != nil {
+		return err
+	}
+	if code == 2 {
+		return inst.replay(r, conn, id, expectedLength)
+	}
+	if !(code == 0 || code == 1) {
+		return errMalformedMessage
 	}
 	var entries []common.SubcriptionInfo
 	if err := r.ReadSubs(&entries); err != nil {
-		return
+		return err
 	}
 
 	bytesRead := uint64(1 + 8)
 	for _, entry := range entries {
-		bytesRead += 8 + uint64(len(entry.Channel)) + 8 + uint64(len(entry.Key))
+		bytesRead += 8 + uint64(len(entry.Channel)) + 8 + uint64(len(entry.Key)) + 8 + uint64(len(entry.Group))
 	}
 	if bytesRead != expectedLength {
-		return
+		return errMalformedMessage
+	}
+
+	if code == 0 {
+		for _, entry := range entries {
+			if err := inst.authorize(conn, id, ActionSubscribe, entry.Channel, entry.Key); err != nil {
+				inst.logger.Warn("Refused subscription", "remote", id.String(), "channel", entry.Channel, "key", entry.Key, "err", err)
+				return err
+			}
+		}
 	}
 
 	for _, entry := range entries {
+		sub := Subscription{Channel: entry.Channel, Key: entry.Key, Group: entry.Group}
 		if code == 0 {
-			db.Subscribe(entry.Channel, entry.Key, id, inst.db)
+			err = inst.store.AddSubscription(inst.ctx, id, sub)
+			if err == nil && sub.Group == "" {
+				inst.deliverRetained(id, entry.Channel, entry.Key)
+			}
 		}
 		if code == 1 {
-			db.Unsubscribe(entry.Channel, entry.Key, id, inst.db)
+			err = inst.store.RemoveSubscription(inst.ctx, id, sub)
 		}
+		if err != nil {
+			inst.logger.Error("Failed to update remote subscription", "remote", id.String(), "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Queues the retained values matching a remote's subscription for delivery to it.
+func (inst *Instance) deliverRetained(remId uuid.UUID, channel, key string) {
+	if _, err := inst.store.DeliverRetained(inst.ctx, remId, channel, key); err != nil {
+		inst.logger.Error("Failed to queue retained messages", "remote", remId.String(), "channel", channel, "key", key, "err", err)
+	}
+}
+
+// Queues the messages a remote asked to have replayed, which the retry loop then sends.
+func (inst *Instance) replay(r *binary.Reader, conn net.Conn, id uuid.UUID, expectedLength uint64) error {
+	var chanLen, keyLen, since uint64
+	if err := r.ReadAll(nil, &chanLen); err != nil {
+		return err
+	}
+	channel, err := r.ReadString(chanLen)
+	if err != nil {
+		return err
+	}
+	if err := r.ReadAll(nil, &keyLen); err != nil {
+		return err
+	}
+	key, err := r.ReadString(keyLen)
+	if err != nil {
+		return err
+	}
+	if err := r.ReadAll(nil, &since); err != nil {
+		return err
 	}
+	if 1+8+chanLen+8+keyLen+8 != expectedLength {
+		return errMalformedMessage
+	}
+	if err := inst.authorize(conn, id, ActionSubscribe, channel, key); err != nil {
+		inst.logger.Warn("Refused replay", "remote", id.String(), "channel", channel, "key", key, "err", err)
+		return err
+	}
+
+	added, err := inst.store.Replay(inst.ctx, id, channel, key, time.UnixMilli(int64(since)))
+	if err != nil {
+		inst.logger.Error("Failed to replay messages", "remote", id.String(), "channel", channel, "key", key, "err", err)
+		return err
+	}
+	inst.logger.Debug("Replaying messages", "remote", id.String(), "channel", channel, "key", key, "count", added)
+	return nil
+}
+
+func buildReplay(channel, key string, since time.Time) []byte {
+	w := binary.NewWriter()
+	w.WriteAll(byte(2), uint64(len(channel)), channel, uint64(len(key)), key, uint64(since.UnixMilli()))
+	return w.Join()
 }
 
-func buildSub(channel, key string) []byte {
+func buildSub(sub common.SubcriptionInfo) []byte {
 	w := binary.NewWriter()
-	w.WriteAll(byte(0), []common.SubcriptionInfo{{Channel: channel, Key: key}})
+	w.WriteAll(byte(0), []common.SubcriptionInfo{sub})
 	return w.Join()
 }
 
-func buildUnSub(channel, key string) []byte {
+func buildUnSub(sub common.SubcriptionInfo) []byte {
 	w := binary.NewWriter()
-	w.WriteAll(byte(1), []common.SubcriptionInfo{{Channel: channel, Key: key}})
+	w.WriteAll(byte(1), []common.SubcriptionInfo{sub})
 	return w.Join()
 }
 
-func buildMes(body []byte, id uint64, channel, key string) []byte {
+func buildMes(body []byte, id uint64, channel, key string, headers map[string]string) []byte {
 	w := binary.NewWriter()
-	w.WriteAll(byte(3), id, uint64(len(channel)), channel, uint64(len(key)), key, uint64(len(body)), body)
+	w.WriteAll(byte(3), id, uint64(len(channel)), channel, uint64(len(key)), key, headers, uint64(len(body)), body)
 	return w.Join()
 }
 
+// Works out who a message on the channel key pair goes to: every remote subscribed by itself, and one member of each
+// queue group with a matching subscription. Returns the recipients along with their connections, which are nil for
+// recipients which aren't connected.
+//
 // TODO: Not exactly sure how an iterator would fit in here
-func (inst *Instance) findRecipients(channel, key string) ([]net.Conn, []uuid.UUID) {
-	conns := make([]net.Conn, 0, len(inst.conns))
-	ids := db.GetSubscriberUUIDs(channel, key, inst.db)
+func (inst *Instance) findRecipients(ctx context.Context, channel, key string) ([]net.Conn, []Recipient, error) {
+	ids, err := inst.store.Subscribers(ctx, channel, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := inst.store.Groups(ctx, channel, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recipients := make([]Recipient, 0, len(ids)+len(groups))
+	for _, id := range ids {
+		recipients = append(recipients, Recipient{Remote: id})
+	}
+	for _, group := range slices.Sorted(maps.Keys(groups)) {
+		if slices.ContainsFunc(recipients, func(r Recipient) bool { return slices.Contains(groups[group], r.Remote) }) {
+			// A member is already receiving the message, which covers the group
+			continue
+		}
+		if member, ok := inst.pickMember(group, groups[group], uuid.Nil); ok {
+			recipients = append(recipients, Recipient{Remote: member, Group: group})
+		}
+	}
 
-	for _, v := range ids {
-		conns = append(conns, inst.conns[v])
+	conns := make([]net.Conn, 0, len(recipients))
+	inst.l.RLock()
+	for _, r := range recipients {
+		conns = append(conns, inst.conns[r.Remote])
 	}
+	inst.l.RUnlock()
 
-	return conns, ids
+	return conns, recipients, nil
 }
 
-func (inst *Instance) send(body []byte, channel, key string, reliable bool) {
-	recipientConns, recipientIds := inst.findRecipients(channel, key)
+func (inst *Instance) send(ctx context.Context, body []byte, channel, key string, reliable bool, opts sendOptions) error {
+	inst.l.RLock()
+	closed := inst.closed
+	inst.l.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	recipientConns, recipients, err := inst.findRecipients(ctx, channel, key)
+	if err != nil {
+		return persistError(err)
+	}
+	recipientIds := make([]uuid.UUID, 0, len(recipients))
+	for _, r := range recipients {
+		recipientIds = append(recipientIds, r.Remote)
+	}
 
 	// This represents an unreliable message
 	id := uint64(0)
+	var seqs []uint64
+	if !reliable && (opts.retain || inst.retention.retains(channel)) {
+		// Kept without any deliveries so it can be replayed to later subscribers, but still sent unreliably now
+		inst.quotaL.RLock()
+		if err := inst.reserve(channel, len(body)); err != nil {
+			inst.quotaL.RUnlock()
+			return err
+		}
+		_, _, err := inst.store.SaveMessage(ctx, StoredMessage{Channel: channel, Key: key, Body: body, Headers: opts.headers, ExpiresAt: opts.expiresAt, SavedAt: time.Now(), Retain: opts.retain}, nil)
+		inst.quotaL.RUnlock()
+		if err != nil {
+			return persistError(err)
+		}
+	}
 	if reliable {
-		id = db.SaveMessage(body, recipientIds, channel, key, inst.db)
+		inst.quotaL.RLock()
+		if err := inst.reserve(channel, len(body)); err != nil {
+			inst.quotaL.RUnlock()
+			return err
+		}
+		inst.attemptL.Lock()
+		id, seqs, err = inst.store.SaveMessage(ctx, StoredMessage{Channel: channel, Key: key, Body: body, Headers: opts.headers, ExpiresAt: opts.expiresAt, Ordered: opts.ordered, SavedAt: time.Now(), Retain: opts.retain}, recipients)
+		inst.quotaL.RUnlock()
+		if err != nil {
+			inst.attemptL.Unlock()
+			return persistError(err)
+		}
+		// Recorded before unlocking so the retry loop doesn't find the deliveries due and send them again in the meantime
+		now := time.Now()
+		for i, v := range recipientConns {
+			if v != nil {
+				inst.recordAttempt(id, recipientIds[i], now, 1)
+			}
+		}
+		inst.attemptL.Unlock()
+		if opts.onSaved != nil {
+			opts.onSaved(id, recipientIds)
+		}
+		if inst.retention.Overflow == OverflowDropOldest {
+			inst.dropOldest()
+		}
 	}
-	mes := buildMes(body, id, channel, key)
+	mes := buildMes(body, id, channel, key, wireHeaders(opts.headers, opts.expiresAt, 0, 0))
 
-	for _, v := range recipientConns {
-		connections.SendBytes(mes, v)
+	var errs []error
+	for i, v := range recipientConns {
+		if v == nil {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNotConnected, recipientIds[i]))
+			continue
+		}
+		if seqs != nil {
+			// Each recipient has its own stream
+			first := inst.firstPending(channel, key, recipientIds[i], seqs[i])
+			mes = buildMes(body, id, channel, key, wireHeaders(opts.headers, opts.expiresAt, seqs[i], first))
+		}
+		if err := connections.SendBytes(mes, v); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrNotConnected, recipientIds[i], err))
+		}
+	}
+
+	// Reliable messages will be resent by the retry loop, so failing to reach a recipient now isn't an error
+	if reliable {
+		return nil
 	}
+	return errors.Join(errs...)
 }
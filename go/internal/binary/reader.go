@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"net"
 
 	"github.com/google/uuid"
 	"github.com/tug-dev/tolliver/go/internal/common"
@@ -15,8 +14,8 @@ type Reader struct {
 	*bufio.Reader
 }
 
-func NewReader(conn net.Conn) *Reader {
-	return &Reader{bufio.NewReader(conn)}
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReader(r)}
 }
 
 func (r *Reader) ReadAll(lens []uint64, destinations ...any) error {
@@ -71,6 +70,12 @@ func (r *Reader) ReadAll(lens []uint64, destinations ...any) error {
 				return err
 			}
 
+		case *map[string]string:
+			err := r.ReadHeaders(v)
+			if err != nil {
+				return err
+			}
+
 		default:
 			panic("Unsupported reader type")
 		}
@@ -152,8 +157,58 @@ func (r *Reader) ReadSubs(dest *[]common.SubcriptionInfo) error {
 		if err != nil {
 			return err
 		}
+		groupLen, err := r.ReadUint64()
+		if err != nil {
+			return err
+		}
+		group, err := r.ReadString(groupLen)
+		if err != nil {
+			return err
+		}
+
+		(*dest)[int(i)] = common.SubcriptionInfo{Channel: channel, Key: key, Group: group}
+	}
+
+	return nil
+}
+
+// Reads a count followed by that many length prefixed name value pairs. The destination is left nil if there are no
+// headers.
+func (r *Reader) ReadHeaders(dest *map[string]string) error {
+	num, err := r.ReadUint64()
+	if err != nil {
+		return err
+	}
+	maxInt := uint64(int(^uint(0) >> 1))
+	if num > maxInt {
+		return errors.New("header count exceeds max int")
+	}
+
+	*dest = nil
+	if num == 0 {
+		return nil
+	}
+	*dest = make(map[string]string, int(num))
+
+	for i := uint64(0); i < num; i++ {
+		nameLen, err := r.ReadUint64()
+		if err != nil {
+			return err
+		}
+		name, err := r.ReadString(nameLen)
+		if err != nil {
+			return err
+		}
+		valueLen, err := r.ReadUint64()
+		if err != nil {
+			return err
+		}
+		value, err := r.ReadString(valueLen)
+		if err != nil {
+			return err
+		}
 
-		(*dest)[int(i)] = common.SubcriptionInfo{Channel: channel, Key: key}
+		(*dest)[name] = value
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package binary
 
 import (
 	"encoding/binary"
+	"slices"
 
 	"github.com/google/uuid"
 	"github.com/tug-dev/tolliver/go/internal/common"
@@ -41,6 +42,9 @@ func (w *Writer) WriteAll(sources ...any) {
 		case []common.SubcriptionInfo:
 			w.WriteSubscriptions(val)
 
+		case map[string]string:
+			w.WriteHeaders(val)
+
 		case []byte:
 			w.WriteBytes(val)
 
@@ -54,8 +58,9 @@ func (w *Writer) Join() []byte {
 	return w.data
 }
 
-func (w *Writer) WriteByte(b byte) {
+func (w *Writer) WriteByte(b byte) error {
 	w.data = append(w.data, b)
+	return nil
 }
 
 func (w *Writer) WriteUint64(n uint64) {
@@ -77,6 +82,25 @@ func (w *Writer) WriteSubscriptions(subs []common.SubcriptionInfo) {
 		w.data = append(w.data, []byte(v.Channel)...)
 		w.WriteUint64(uint64(len([]byte(v.Key))))
 		w.data = append(w.data, []byte(v.Key)...)
+		w.WriteUint64(uint64(len([]byte(v.Group))))
+		w.data = append(w.data, []byte(v.Group)...)
+	}
+}
+
+// Writes the headers sorted by name so that the same headers always produce the same bytes.
+func (w *Writer) WriteHeaders(headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	w.WriteUint64(uint64(len(names)))
+	for _, k := range names {
+		w.WriteUint64(uint64(len(k)))
+		w.WriteString(k)
+		w.WriteUint64(uint64(len(headers[k])))
+		w.WriteString(headers[k])
 	}
 }
 
@@ -1,3 +1,3 @@
 package common
 
-const TolliverVersion uint64 = 1
+const TolliverVersion uint64 = 4
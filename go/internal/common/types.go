@@ -3,4 +3,6 @@ package common
 type SubcriptionInfo struct {
 	Channel string
 	Key     string
+	// Queue group the subscriber is a member of, blank if it isn't in one
+	Group string
 }
@@ -1,6 +1,7 @@
 package connections
 
 import (
+	"errors"
 	"fmt"
 	"net"
 )
@@ -11,19 +12,26 @@ type Wrapper struct {
 	Conn net.Conn
 }
 
-func SendBytes(mes []byte, conn net.Conn) {
-	n, err := conn.Write(mes)
-	var tot = n
-
-	for err != nil || tot != len(mes) {
-		n, err = conn.Write(mes[tot:])
+// Writes the whole of mes to conn, returning the first write error encountered.
+func SendBytes(mes []byte, conn net.Conn) error {
+	for tot := 0; tot < len(mes); {
+		n, err := conn.Write(mes[tot:])
+		if err != nil {
+			return err
+		}
 		tot += n
 	}
+
+	return nil
 }
 
+// Accepts connections on lst until it is closed, passing each one to handle.
 func HandleListener(lst net.Listener, handle func(conn net.Conn)) {
 	for {
 		conn, err := lst.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("%e\n", err)
 			continue
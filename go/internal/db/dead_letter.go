@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DeadLetterRejected    = "rejected"
+	DeadLetterExpired     = "expired"
+	DeadLetterMaxAttempts = "max_attempts"
+)
+
+type DeadLetter struct {
+	Id uint64
+	Delivery
+	Reason string
+	Detail string
+	DeadAt time.Time
+}
+
+// Zero valued fields match every dead letter.
+type DeadLetterFilter struct {
+	Channel   string
+	Key       string
+	Recipient uuid.UUID
+	Reason    string
+	Limit     int
+}
+
+// Moves the deliveries which expired at or before now into the dead letter table, returning what was moved.
+func ExpireDeliveries(ctx context.Context, db *sql.DB, now time.Time) ([]DeadLetter, error) {
+	return deadLetter(ctx, db, "d.expires_at <= ?", []any{now.UnixMilli()}, DeadLetterExpired, "", now)
+}
+
+// Moves deliveries which have been attempted maxAttempts times, and whose final attempt has gone unacked until its next
+// attempt was due, into the dead letter table.
+func ExhaustDeliveries(ctx context.Context, db *sql.DB, maxAttempts int, now time.Time) ([]DeadLetter, error) {
+	return deadLetter(ctx, db, "d.attempts >= ? AND d.next_attempt <= ?", []any{maxAttempts, now.UnixMilli()}, DeadLetterMaxAttempts, "", now)
+}
+
+// Moves a delivery which the recipient nacked into the dead letter table.
+func Reject(ctx context.Context, db *sql.DB, mesId uint64, recipient uuid.UUID, detail string, now time.Time) ([]DeadLetter, error) {
+	return deadLetter(ctx, db, "d.message_id = ? AND d.recipient_id = ?", []any{int64(mesId), recipient[:]}, DeadLetterRejected, detail, now)
+}
+
+func deadLetter(ctx context.Context, db *sql.DB, where string, args []any, reason, detail string, now time.Time) ([]DeadLetter, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.QueryContext(ctx, "SELECT d.id, "+deliveryColumns+" FROM delivery d JOIN message m ON m.id = d.message_id WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var deliveries []Delivery
+	for res.Next() {
+		var id int64
+		build, dest := deliveryScanner()
+		if err := res.Scan(append([]any{&id}, dest...)...); err != nil {
+			res.Close()
+			return nil, err
+		}
+		d, err := build()
+		if err != nil {
+			res.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		deliveries = append(deliveries, d)
+	}
+	res.Close()
+	if err := res.Err(); err != nil || len(deliveries) == 0 {
+		return nil, err
+	}
+
+	out := make([]DeadLetter, 0, len(deliveries))
+	for i, d := range deliveries {
+		res, err := tx.ExecContext(ctx, "INSERT INTO dead_letter (message_id, recipient_id, reason, detail, attempts, dead_at, group_name, seq, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", int64(d.MesId), d.Receiver[:], reason, detail, d.Attempts, now.UnixMilli(), d.Group, sql.NullInt64{Int64: int64(d.Seq), Valid: d.Seq != 0}, nullTime(d.ExpiresAt))
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM delivery WHERE id = $1", ids[i]); err != nil {
+			return nil, err
+		}
+
+		out = append(out, DeadLetter{Id: uint64(id), Delivery: d, Reason: reason, Detail: detail, DeadAt: now})
+	}
+
+	return out, tx.Commit()
+}
+
+func GetDeadLetters(ctx context.Context, db *sql.DB, filter DeadLetterFilter) ([]DeadLetter, error) {
+	var conds []string
+	var args []any
+	if filter.Channel != "" {
+		conds = append(conds, "m.channel = ?")
+		args = append(args, filter.Channel)
+	}
+	if filter.Key != "" {
+		conds = append(conds, "m.key = ?")
+		args = append(args, filter.Key)
+	}
+	if filter.Recipient != uuid.Nil {
+		conds = append(conds, "d.recipient_id = ?")
+		args = append(args, filter.Recipient[:])
+	}
+	if filter.Reason != "" {
+		conds = append(conds, "d.reason = ?")
+		args = append(args, filter.Reason)
+	}
+
+	query := "SELECT d.id, d.reason, d.detail, d.dead_at, " + deliveryColumns + " FROM dead_letter d JOIN message m ON m.id = d.message_id"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY d.id"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	res, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	out := make([]DeadLetter, 0, 10)
+	for res.Next() {
+		var dl DeadLetter
+		var id, deadAt int64
+		build, dest := deliveryScanner()
+		if err := res.Scan(append([]any{&id, &dl.Reason, &dl.Detail, &deadAt}, dest...)...); err != nil {
+			return nil, err
+		}
+		if dl.Delivery, err = build(); err != nil {
+			return nil, err
+		}
+		dl.Id = uint64(id)
+		dl.DeadAt = time.UnixMilli(deadAt)
+		out = append(out, dl)
+	}
+
+	return out, res.Err()
+}
+
+// Turns a dead letter back into a pending delivery which is due straight away, returning false if there is no dead
+// letter with the id. If the delivery had expired its expiry is removed so that it isn't immediately dead lettered again,
+// and if it was ordered it is given the next sequence number in the recipient's stream, since the recipient may already
+// have moved past the old one. Other recipients' deliveries of the message are left as they are.
+func Requeue(ctx context.Context, db *sql.DB, id uint64, now time.Time) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var mesId int64
+	var recipientId []byte
+	var group, channel, key string
+	var seq, expiresAt sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT d.message_id, d.recipient_id, d.group_name, d.seq, d.expires_at, m.channel, m.key FROM dead_letter d JOIN message m ON m.id = d.message_id WHERE d.id = $1", int64(id)).Scan(&mesId, &recipientId, &group, &seq, &expiresAt, &channel, &key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	recipient, err := uuid.FromBytes(recipientId)
+	if err != nil {
+		return false, err
+	}
+
+	if seq.Valid {
+		if seq.Int64, err = nextSeq(ctx, tx, channel, key, recipient); err != nil {
+			return false, err
+		}
+	}
+	if expiresAt.Valid && expiresAt.Int64 <= now.UnixMilli() {
+		expiresAt.Valid = false
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO delivery (message_id, recipient_id, group_name, seq, expires_at) VALUES ($1, $2, $3, $4, $5)", mesId, recipientId, group, seq, expiresAt); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM dead_letter WHERE id = $1", int64(id)); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Deletes a dead letter, returning false if there is no dead letter with the id.
+func PurgeDeadLetter(ctx context.Context, db *sql.DB, id uint64) (bool, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM dead_letter WHERE id = $1", int64(id))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
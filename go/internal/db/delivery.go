@@ -1,8 +1,10 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,58 +15,157 @@ type Delivery struct {
 	MesId    uint64
 	Channel  string
 	Key      string
+	Headers  map[string]string
+	// Number of times the message has already been sent to the receiver
+	Attempts int
+	// Zero if the message never expires
+	ExpiresAt time.Time
+	// Position of the message in the receiver's stream on its channel and key, zero unless it was sent in order
+	Seq uint64
+	// Queue group the receiver was chosen from, blank if the message was addressed to it directly
+	Group string
 }
 
-func GetWork(db *sql.DB) []Delivery {
-	res, err := db.Query("SELECT (message_id, recipient_id) FROM delivery")
+// A remote a message is saved for.
+type Recipient struct {
+	ID uuid.UUID
+	// Queue group the remote was chosen from, blank if the message is addressed to it directly
+	Group string
+}
+
+const deliveryColumns = "d.message_id, d.recipient_id, m.channel, m.key, m.data, m.headers, d.attempts, d.expires_at, d.seq, d.group_name"
+
+// Returns the deliveries to the given recipients which are due to be sent at now.
+func GetWork(ctx context.Context, db *sql.DB, now time.Time, recipients []uuid.UUID) ([]Delivery, error) {
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, 0, len(recipients)+1)
+	args = append(args, now.UnixMilli())
+	placeholders := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		args = append(args, r[:])
+		placeholders = append(placeholders, "?")
+	}
+
+	res, err := db.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.next_attempt <= ? AND d.recipient_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY d.message_id", args...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	out := make([]Delivery, 0, 10)
-	for res.Next() {
-		var mesId int
-		var recipientId []byte
-		var data []byte
-		var channel, key string
-
-		res.Scan(&mesId, &recipientId)
-		recipientUUID, _ := uuid.FromBytes(recipientId)
-		message, err := db.Query("SELECT channel, key, data FROM message WHERE id = $1", mesId)
-		if err != nil || !message.Next() {
-			log.Fatal("Message not found")
-		}
+	return scanDeliveries(res)
+}
+
+// Returns the deliveries to members of queue groups which are due to be sent at now, whichever member they are addressed
+// to, so that they can be moved to another member.
+func GetGroupWork(ctx context.Context, db *sql.DB, now time.Time) ([]Delivery, error) {
+	res, err := db.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.group_name != '' AND d.next_attempt <= $1 ORDER BY d.message_id", now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDeliveries(res)
+}
+
+// Moves a delivery to another member of its queue group, due straight away and keeping its attempts. An ordered
+// message is given the next sequence number in the new member's stream. Returns false if the delivery no longer exists
+// or the new recipient already has a delivery of the message.
+func Reassign(ctx context.Context, db *sql.DB, mesId uint64, from, to uuid.UUID) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE delivery SET recipient_id = $1, next_attempt = 0 WHERE message_id = $2 AND recipient_id = $3 AND NOT EXISTS (SELECT 1 FROM delivery WHERE message_id = $2 AND recipient_id = $1)", to[:], int64(mesId), from[:])
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
 
-		message.Scan(&channel, &key, &data)
-		out = append(out, Delivery{Receiver: recipientUUID, Payload: data, MesId: uint64(mesId), Channel: channel, Key: key})
+	var channel, key string
+	var seq sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT m.channel, m.key, d.seq FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.message_id = $1 AND d.recipient_id = $2", int64(mesId), to[:]).Scan(&channel, &key, &seq); err != nil {
+		return false, err
+	}
+	if seq.Valid {
+		next, err := nextSeq(ctx, tx, channel, key, to)
+		if err != nil {
+			return false, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE delivery SET seq = $1 WHERE message_id = $2 AND recipient_id = $3", next, int64(mesId), to[:]); err != nil {
+			return false, err
+		}
 	}
 
-	return out
+	return true, tx.Commit()
 }
 
-func GetUndeliveredByUUID(db *sql.DB, id uuid.UUID) []Delivery {
-	res, err := db.Query("SELECT (message_id, recipient_id) FROM delivery WHERE recipient_id = $1", id[:])
+func GetUndeliveredByUUID(ctx context.Context, db *sql.DB, id uuid.UUID) ([]Delivery, error) {
+	res, err := db.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.recipient_id = $1 ORDER BY d.message_id", id[:])
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	return scanDeliveries(res)
+}
+
+// Records that the message was sent to the recipient at the given time, and when it should next be sent if it still
+// hasn't been acked.
+func RecordAttempt(ctx context.Context, db *sql.DB, mesId uint64, recipient uuid.UUID, at, next time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE delivery SET attempts = attempts + 1, last_attempt = $1, next_attempt = $2 WHERE message_id = $3 AND recipient_id = $4", at.UnixMilli(), next.UnixMilli(), int64(mesId), recipient[:])
+	return err
+}
+
+func scanDeliveries(res *sql.Rows) ([]Delivery, error) {
+	defer res.Close()
+
 	out := make([]Delivery, 0, 10)
 	for res.Next() {
-		var mesId int
-		var recipientId []byte
-		var data []byte
-		var channel, key string
-
-		res.Scan(&mesId, &recipientId)
-		recipientUUID, _ := uuid.FromBytes(recipientId)
-		message, err := db.Query("SELECT channel, key, data FROM message WHERE id = $1", mesId)
-		if err != nil || !message.Next() {
-			log.Fatal("Message not found")
+		build, dest := deliveryScanner()
+		if err := res.Scan(dest...); err != nil {
+			return nil, err
+		}
+		d, err := build()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+
+	return out, res.Err()
+}
+
+// Returns the scan destinations for deliveryColumns, along with a function which builds the Delivery once they have
+// been scanned into.
+func deliveryScanner() (func() (Delivery, error), []any) {
+	var mesId int64
+	var recipientId []byte
+	var data, headerBytes []byte
+	var channel, key string
+	var attempts int
+	var expiresAt, seq sql.NullInt64
+	var group string
+
+	build := func() (Delivery, error) {
+		recipientUUID, err := uuid.FromBytes(recipientId)
+		if err != nil {
+			return Delivery{}, err
+		}
+		headers, err := decodeHeaders(headerBytes)
+		if err != nil {
+			return Delivery{}, err
 		}
 
-		message.Scan(&channel, &key, &data)
-		out = append(out, Delivery{Receiver: recipientUUID, Payload: data, MesId: uint64(mesId), Channel: channel, Key: key})
+		d := Delivery{Receiver: recipientUUID, Payload: data, MesId: uint64(mesId), Channel: channel, Key: key, Headers: headers, Attempts: attempts, Seq: uint64(seq.Int64), Group: group}
+		if expiresAt.Valid {
+			d.ExpiresAt = time.UnixMilli(expiresAt.Int64)
+		}
+		return d, nil
 	}
 
-	return out
+	return build, []any{&mesId, &recipientId, &channel, &key, &data, &headerBytes, &attempts, &expiresAt, &seq, &group}
 }
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Deletes messages saved before the given time which have no pending deliveries or dead letters left and aren't
+// retained, returning how many were deleted. Messages on the channels in the map are instead deleted once they were
+// saved before the time given for their channel.
+func DeleteUnreferenced(ctx context.Context, db *sql.DB, savedBefore time.Time, channels map[string]time.Time) (int, error) {
+	cutoff := "?"
+	var args []any
+	if len(channels) > 0 {
+		cutoff = "CASE channel"
+		for channel, before := range channels {
+			cutoff += " WHEN ? THEN ?"
+			args = append(args, channel, before.UnixMilli())
+		}
+		cutoff += " ELSE ? END"
+	}
+	args = append(args, savedBefore.UnixMilli())
+
+	res, err := db.ExecContext(ctx, `DELETE FROM message WHERE COALESCE(saved_at, 0) < `+cutoff+`
+    AND NOT EXISTS (SELECT 1 FROM delivery d WHERE d.message_id = message.id)
+    AND NOT EXISTS (SELECT 1 FROM dead_letter l WHERE l.message_id = message.id)
+    AND NOT EXISTS (SELECT 1 FROM retained r WHERE r.message_id = message.id)`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Returns the number of saved messages and the total size of their bodies in bytes, leaving out messages on the
+// excluded channel.
+func Usage(ctx context.Context, db *sql.DB, excluded string) (int, int64, error) {
+	var messages int
+	var bytes int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(length(data)), 0) FROM message WHERE channel != $1", excluded).Scan(&messages, &bytes)
+	return messages, bytes, err
+}
+
+// Deletes the oldest messages, along with their pending deliveries, dead letters and retained values, until no more
+// than maxMessages messages whose bodies total no more than maxBytes are left. A limit of 0 means no limit. Messages on
+// the excluded channel are neither counted nor deleted. Returns the pending deliveries which were deleted.
+func DropOldest(ctx context.Context, db *sql.DB, maxMessages int, maxBytes int64, excluded string) ([]Delivery, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var messages int
+	var bytes int64
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(length(data)), 0) FROM message WHERE channel != $1", excluded).Scan(&messages, &bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	over := func() bool {
+		return (maxMessages > 0 && messages > maxMessages) || (maxBytes > 0 && bytes > maxBytes)
+	}
+	if !over() {
+		return nil, nil
+	}
+
+	res, err := tx.QueryContext(ctx, "SELECT id, length(data) FROM message WHERE channel != $1 ORDER BY id", excluded)
+	if err != nil {
+		return nil, err
+	}
+	var last int64
+	for over() && res.Next() {
+		var size int64
+		if err := res.Scan(&last, &size); err != nil {
+			res.Close()
+			return nil, err
+		}
+		messages--
+		bytes -= size
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err = tx.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.message_id <= $1 AND m.channel != $2 ORDER BY d.message_id", last, excluded)
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := scanDeliveries(res)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range []string{"delivery", "dead_letter", "retained"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE message_id IN (SELECT id FROM message WHERE id <= $1 AND channel != $2)", last, excluded); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message WHERE id <= $1 AND channel != $2", last, excluded); err != nil {
+		return nil, err
+	}
+
+	return dropped, tx.Commit()
+}
+
+// Returns the space freed by deleted rows to the filesystem. Databases created with incremental vacuuming enabled are
+// trimmed cheaply, while others are rebuilt with a full VACUUM, which needs as much free disk space as the database
+// takes up and blocks other writers until it finishes.
+func Compact(ctx context.Context, db *sql.DB) error {
+	var free int
+	if err := db.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&free); err != nil {
+		return err
+	}
+	if free == 0 {
+		return nil
+	}
+
+	var mode int
+	if err := db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	// 2 is INCREMENTAL
+	if mode == 2 {
+		_, err := db.ExecContext(ctx, "PRAGMA incremental_vacuum")
+		return err
+	}
+	_, err := db.ExecContext(ctx, "VACUUM")
+	return err
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reports whether the message from sender has been recorded as processed.
+func Processed(ctx context.Context, db *sql.DB, sender uuid.UUID, mesId uint64) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM inbox WHERE sender_id = $1 AND message_id = $2", sender[:], int64(mesId)).Scan(&n)
+	return n > 0, err
+}
+
+// Records that the message from sender was processed at the given time.
+func MarkProcessed(ctx context.Context, db *sql.DB, sender uuid.UUID, mesId uint64, at time.Time) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO inbox (sender_id, message_id, processed_at) VALUES ($1, $2, $3)", sender[:], int64(mesId), at.UnixMilli())
+	return err
+}
+
+// Forgets messages processed before the given time.
+func PruneInbox(ctx context.Context, db *sql.DB, before time.Time) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM inbox WHERE processed_at < $1", before.UnixMilli())
+	return err
+}
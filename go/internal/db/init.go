@@ -1,47 +1,49 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	_ "embed"
+	"database/sql/driver"
 
 	"github.com/google/uuid"
-	_ "modernc.org/sqlite"
+	"github.com/tug-dev/tolliver/go/internal/match"
+	"modernc.org/sqlite"
 )
 
-//go:embed schema.sql
-var schema string
+func init() {
+	// Lets queries match channels against subscription patterns the same way instances do in memory
+	sqlite.MustRegisterDeterministicScalarFunction("tolliver_match", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, _ := args[0].(string)
+		channel, _ := args[1].(string)
+		return match.Match(pattern, channel), nil
+	})
+}
 
-func Init(db *sql.DB) uuid.UUID {
-	_, err := db.Exec(schema)
+// Migrates the database to the latest schema and returns this instance's UUID, generating and saving a new one on first
+// use.
+func Init(ctx context.Context, db *sql.DB) (uuid.UUID, error) {
+	err := Migrate(ctx, db)
 	if err != nil {
-		panic(err)
+		return uuid.UUID{}, err
 	}
 
-	rows, err := db.Query("SELECT uuid FROM instance")
-	if err != nil {
-		panic(err)
+	var idBytes []byte
+	err = db.QueryRowContext(ctx, "SELECT uuid FROM instance LIMIT 1").Scan(&idBytes)
+	if err == nil {
+		return uuid.FromBytes(idBytes)
 	}
-
-	var id uuid.UUID
-	found := false
-	defer rows.Close()
-	for rows.Next() {
-		var idBytes []byte
-		if err := rows.Scan(&idBytes); err != nil {
-			panic(err)
-		}
-
-		if idBytes != nil {
-			id, _ = uuid.FromBytes(idBytes)
-			found = true
-			break
-		}
+	if err != sql.ErrNoRows {
+		return uuid.UUID{}, err
 	}
 
-	if !found {
-		id, _ = uuid.NewV7()
-		db.Exec("INSERT INTO instance (uuid) VALUES ($1)", id[:])
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO instance (uuid) VALUES ($1)", id[:])
+	if err != nil {
+		return uuid.UUID{}, err
 	}
 
-	return id
+	return id, nil
 }
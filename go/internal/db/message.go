@@ -1,29 +1,139 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/binary"
 	_ "modernc.org/sqlite"
 )
 
-func SaveMessage(mes []byte, recipients []uuid.UUID, channel, key string, db *sql.DB) uint64 {
-	res, err := db.Exec("INSERT INTO message (channel, key, data) VALUES ($1, $2, $3)", channel, key, mes)
+type Message struct {
+	Channel string
+	Key     string
+	Data    []byte
+	Headers map[string]string
+	// Zero if the message never expires
+	ExpiresAt time.Time
+	// Whether each recipient is given the next sequence number in its stream on the channel and key
+	Ordered bool
+	SavedAt time.Time
+	// Whether the message replaces the retained value on its channel and key, or clears it if Data is empty
+	Retain bool
+}
+
+// Runs statements either directly on a database or inside a transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Saves a message along with a pending delivery for each recipient, returning the id of the new message and, if it is
+// ordered, the sequence number given to each recipient.
+func SaveMessage(ctx context.Context, mes Message, recipients []Recipient, db *sql.DB) (uint64, []uint64, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	id, seqs, err := SaveMessageTx(ctx, mes, recipients, tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, seqs, tx.Commit()
+}
+
+// Saves a message like SaveMessage, but as part of a transaction the caller commits.
+func SaveMessageTx(ctx context.Context, mes Message, recipients []Recipient, tx *sql.Tx) (uint64, []uint64, error) {
+	if mes.Data == nil {
+		// The driver stores a nil slice as NULL
+		mes.Data = []byte{}
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO message (channel, key, data, headers, expires_at, saved_at) VALUES ($1, $2, $3, $4, $5, $6)", mes.Channel, mes.Key, mes.Data, encodeHeaders(mes.Headers), nullTime(mes.ExpiresAt), nullTime(mes.SavedAt))
+	if err != nil {
+		return 0, nil, err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 
+	var seqs []uint64
 	for _, v := range recipients {
-		_, err := db.Exec("INSERT INTO delivery (message_id, recipient_id) VALUES ($1, $2)", id, v[:])
+		var seq sql.NullInt64
+		if mes.Ordered {
+			seq.Int64, err = nextSeq(ctx, tx, mes.Channel, mes.Key, v.ID)
+			if err != nil {
+				return 0, nil, err
+			}
+			seq.Valid = true
+			seqs = append(seqs, uint64(seq.Int64))
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO delivery (message_id, recipient_id, group_name, seq, expires_at) VALUES ($1, $2, $3, $4, $5)", id, v.ID[:], v.Group, seq, nullTime(mes.ExpiresAt))
 		if err != nil {
-			panic(err)
+			return 0, nil, err
+		}
+	}
+
+	if mes.Retain {
+		if err := retain(ctx, tx, mes.Channel, mes.Key, id, len(mes.Data) == 0); err != nil {
+			return 0, nil, err
 		}
 	}
 
-	return uint64(id)
+	return uint64(id), seqs, nil
+}
+
+// Takes the next sequence number for an ordered message to the recipient on the channel and key. A recipient's first
+// number follows on from any given out before numbers were kept per recipient, which are under a blank recipient.
+func nextSeq(ctx context.Context, tx *sql.Tx, channel, key string, recipient uuid.UUID) (int64, error) {
+	var seq int64
+	err := tx.QueryRowContext(ctx, `INSERT INTO message_sequence (channel, key, recipient_id, last_seq)
+    VALUES ($1, $2, $3, (SELECT COALESCE(MAX(last_seq), 0) + 1 FROM message_sequence WHERE channel = $1 AND key = $2 AND recipient_id = X''))
+    ON CONFLICT (channel, key, recipient_id) DO UPDATE SET last_seq = last_seq + 1 RETURNING last_seq`, channel, key, recipient[:]).Scan(&seq)
+	return seq, err
+}
+
+// Returns the lowest sequence number of the ordered messages on the channel and key which are still waiting to be
+// delivered to the recipient, or 0 if there are none.
+func FirstPendingSeq(ctx context.Context, db *sql.DB, channel, key string, recipient uuid.UUID) (uint64, error) {
+	var seq sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MIN(d.seq) FROM delivery d JOIN message m ON m.id = d.message_id WHERE d.recipient_id = $1 AND m.channel = $2 AND m.key = $3", recipient[:], channel, key).Scan(&seq)
+	return uint64(seq.Int64), err
+}
+
+func encodeHeaders(headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	w := binary.NewWriter()
+	w.WriteHeaders(headers)
+	return w.Join()
+}
+
+func decodeHeaders(b []byte) (map[string]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	var headers map[string]string
+	err := binary.NewReader(bytes.NewReader(b)).ReadHeaders(&headers)
+	return headers, err
+}
+
+func nullTime(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
 }
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var ErrSchemaTooNew = errors.New("The database was created by a newer version of tolliver")
+
+// A step in upgrading the database. Migrations are applied in order, each exactly once, and must never be changed once
+// released; changes to the schema go in a new migration at the end of the list.
+type migration struct {
+	version int
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	// The schema from before the database was versioned, which is also how such databases are recognised
+	{1, script("001_baseline.sql")},
+	{2, steps(
+		addColumn("message", "headers", "BLOB"),
+		// Unix milliseconds after which the message should no longer be delivered, NULL if it never expires
+		addColumn("message", "expires_at", "INTEGER"),
+		// Number of times the message has been sent to the recipient
+		addColumn("delivery", "attempts", "INTEGER NOT NULL DEFAULT 0"),
+		// Unix milliseconds of the most recent attempt
+		addColumn("delivery", "last_attempt", "INTEGER"),
+		// Unix milliseconds after which the message should be sent again, 0 means as soon as possible
+		addColumn("delivery", "next_attempt", "INTEGER NOT NULL DEFAULT 0"),
+		script("002_reliability.sql"),
+	)},
+	{3, script("003_local_subscriptions.sql")},
+	{4, steps(
+		// Position of the message on its channel and key if it was sent in order, NULL otherwise
+		addColumn("message", "seq", "INTEGER"),
+		script("004_ordering.sql"),
+	)},
+	{5, script("005_inbox.sql")},
+	{6, steps(
+		// Unix milliseconds when the message was saved, NULL for messages saved before it was recorded
+		addColumn("message", "saved_at", "INTEGER"),
+		script("006_retention.sql"),
+	)},
+	{7, script("007_retained.sql")},
+	{8, steps(
+		// Queue group the remote subscribed as a member of, blank if it subscribed by itself
+		addColumn("subscription", "group_name", "TEXT NOT NULL DEFAULT ''"),
+		// Queue group the recipient was chosen from, blank if the message was addressed to it directly
+		addColumn("delivery", "group_name", "TEXT NOT NULL DEFAULT ''"),
+		addColumn("dead_letter", "group_name", "TEXT NOT NULL DEFAULT ''"),
+		script("008_queue_groups.sql"),
+	)},
+	{9, script("009_certificate_pins.sql")},
+	{10, steps(
+		// Position of the message in the recipient's stream on its channel and key if it was sent in order, NULL
+		// otherwise
+		addColumn("delivery", "seq", "INTEGER"),
+		addColumn("dead_letter", "seq", "INTEGER"),
+		script("010_recipient_sequences.sql"),
+	)},
+	{11, steps(
+		// Unix milliseconds after which the message should no longer be delivered to the recipient, NULL if it never
+		// expires. Starts as the message's expiry.
+		addColumn("delivery", "expires_at", "INTEGER"),
+		addColumn("dead_letter", "expires_at", "INTEGER"),
+		script("011_delivery_expiry.sql"),
+	)},
+}
+
+// The version of the schema this build of tolliver uses.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Brings the database up to the latest schema version inside a single transaction, so a failed upgrade leaves it as it
+// was. Returns ErrSchemaTooNew if the database has already been upgraded past what this build knows about.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY NOT NULL,
+    -- Unix milliseconds when the migration was applied
+    applied_at INTEGER NOT NULL
+)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion() {
+		return fmt.Errorf("%w: database is at version %d, but only up to %d is supported", ErrSchemaTooNew, current, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(ctx, tx); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, applied_at) VALUES ($1, $2)", m.version, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Runs one of the embedded migration scripts.
+func script(name string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		s, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, string(s))
+		return err
+	}
+}
+
+func steps(up ...func(context.Context, *sql.Tx) error) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, u := range up {
+			if err := u(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Adds a column to a table unless it is already there. SQLite has no ADD COLUMN IF NOT EXISTS, and databases created
+// by development builds from before versioning may have some of the columns later migrations add.
+func addColumn(table, column, definition string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pragma_table_info($1) WHERE name = $2)", table, column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
@@ -0,0 +1,26 @@
+CREATE INDEX IF NOT EXISTS delivery_next_attempt_idx ON delivery(
+    next_attempt
+);
+
+CREATE INDEX IF NOT EXISTS message_expires_at_idx ON message (
+    expires_at
+);
+
+-- Deliveries which were given up on, kept so they can be inspected and requeued
+CREATE TABLE IF NOT EXISTS dead_letter (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    message_id INTEGER NOT NULL,
+    recipient_id BLOB NOT NULL,
+    -- One of rejected, expired or max_attempts
+    reason TEXT NOT NULL,
+    -- Reason given by the recipient when it rejected the message
+    detail TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL,
+    -- Unix milliseconds when the delivery was given up on
+    dead_at INTEGER NOT NULL,
+    FOREIGN KEY(message_id) REFERENCES message(id)
+);
+
+CREATE INDEX IF NOT EXISTS dead_letter_message_id_idx ON dead_letter (
+    message_id
+);
@@ -0,0 +1,6 @@
+-- What this instance itself is subscribed to, advertised to remotes during handshakes
+CREATE TABLE IF NOT EXISTS local_subscription (
+    channel TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    PRIMARY KEY (channel, `key`)
+);
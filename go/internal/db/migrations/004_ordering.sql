@@ -0,0 +1,7 @@
+-- The last sequence number given to an ordered message on each channel and key
+CREATE TABLE IF NOT EXISTS message_sequence (
+    channel TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    last_seq INTEGER NOT NULL,
+    PRIMARY KEY (channel, `key`)
+);
@@ -0,0 +1,12 @@
+-- Reliable messages received from other instances which have been processed, used to drop copies resent after a lost ack
+CREATE TABLE IF NOT EXISTS inbox (
+    sender_id BLOB NOT NULL,
+    message_id INTEGER NOT NULL,
+    -- Unix milliseconds when the message was acked
+    processed_at INTEGER NOT NULL,
+    PRIMARY KEY (sender_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS inbox_processed_at_idx ON inbox (
+    processed_at
+);
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS message_saved_at_idx ON message (
+    saved_at
+);
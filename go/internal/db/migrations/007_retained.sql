@@ -0,0 +1,8 @@
+-- The last message sent with Retain on each channel and key, delivered to remotes when they subscribe
+CREATE TABLE IF NOT EXISTS retained (
+    channel TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    message_id INTEGER NOT NULL,
+    PRIMARY KEY (channel, `key`),
+    FOREIGN KEY(message_id) REFERENCES message(id)
+);
@@ -0,0 +1,14 @@
+-- The queue group is part of what identifies a local subscription, so the table is rebuilt with it in the primary key
+CREATE TABLE local_subscription_new (
+    channel TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    group_name TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (channel, `key`, group_name)
+);
+INSERT INTO local_subscription_new (rowid, channel, `key`) SELECT rowid, channel, `key` FROM local_subscription;
+DROP TABLE local_subscription;
+ALTER TABLE local_subscription_new RENAME TO local_subscription;
+
+CREATE INDEX IF NOT EXISTS delivery_group_name_idx ON delivery (
+    group_name
+) WHERE group_name != '';
@@ -0,0 +1,8 @@
+-- Certificates which remotes may present for their UUID, used to stop a remote with a valid certificate from claiming
+-- to be another instance
+CREATE TABLE IF NOT EXISTS certificate_pin (
+    remote_id BLOB NOT NULL,
+    -- SHA-256 of the DER encoded certificate
+    fingerprint BLOB NOT NULL,
+    PRIMARY KEY (remote_id, fingerprint)
+);
@@ -0,0 +1,17 @@
+-- Each recipient has its own sequence of ordered messages, so sequence numbers move from messages to their deliveries
+UPDATE delivery SET seq = (SELECT seq FROM message WHERE message.id = delivery.message_id);
+UPDATE dead_letter SET seq = (SELECT seq FROM message WHERE message.id = dead_letter.message_id);
+ALTER TABLE message DROP COLUMN seq;
+
+-- Numbers given out before they were kept per recipient stay under a blank recipient, so that remotes still expecting
+-- the next of them aren't sent numbers they have already passed
+CREATE TABLE message_sequence_new (
+    channel TEXT NOT NULL,
+    `key` TEXT NOT NULL,
+    recipient_id BLOB NOT NULL,
+    last_seq INTEGER NOT NULL,
+    PRIMARY KEY (channel, `key`, recipient_id)
+);
+INSERT INTO message_sequence_new (channel, `key`, recipient_id, last_seq) SELECT channel, `key`, X'', last_seq FROM message_sequence;
+DROP TABLE message_sequence;
+ALTER TABLE message_sequence_new RENAME TO message_sequence;
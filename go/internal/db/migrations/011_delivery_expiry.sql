@@ -0,0 +1,8 @@
+-- Requeuing an expired delivery lifts the expiry for that recipient alone, so each delivery carries its own copy
+UPDATE delivery SET expires_at = (SELECT expires_at FROM message WHERE message.id = delivery.message_id);
+UPDATE dead_letter SET expires_at = (SELECT expires_at FROM message WHERE message.id = dead_letter.message_id);
+
+DROP INDEX IF EXISTS message_expires_at_idx;
+CREATE INDEX IF NOT EXISTS delivery_expires_at_idx ON delivery (
+    expires_at
+);
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// Records that the remote may present the certificate with the given fingerprint, doing nothing if it already may.
+func PinCertificate(ctx context.Context, db *sql.DB, remote uuid.UUID, fingerprint []byte) error {
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO certificate_pin (remote_id, fingerprint) VALUES ($1, $2)", remote[:], fingerprint)
+	return err
+}
+
+// Removes a pinned certificate, returning false if it wasn't pinned for the remote.
+func UnpinCertificate(ctx context.Context, db *sql.DB, remote uuid.UUID, fingerprint []byte) (bool, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM certificate_pin WHERE remote_id = $1 AND fingerprint = $2", remote[:], fingerprint)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Reports whether the certificate with the given fingerprint is pinned for the remote.
+func CertificatePinned(ctx context.Context, db *sql.DB, remote uuid.UUID, fingerprint []byte) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM certificate_pin WHERE remote_id = $1 AND fingerprint = $2", remote[:], fingerprint).Scan(&n)
+	return n > 0, err
+}
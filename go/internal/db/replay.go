@@ -0,0 +1,26 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Adds a pending delivery to the recipient for every message on the channel key pair saved at or after since which
+// isn't already pending for it, returning how many were added. The channel may be a pattern, and blank channels and
+// keys match anything, except that messages on the excluded channel are never replayed.
+func Replay(ctx context.Context, db *sql.DB, recipient uuid.UUID, channel, key, excluded string, since time.Time) (int, error) {
+	res, err := db.ExecContext(ctx, `INSERT INTO delivery (message_id, recipient_id, expires_at)
+    SELECT m.id, $1, m.expires_at FROM message m
+    WHERE tolliver_match($2, m.channel) AND ($3 = '' OR m.key = $3) AND m.channel != $4 AND COALESCE(m.saved_at, 0) >= $5
+    AND NOT EXISTS (SELECT 1 FROM delivery d WHERE d.message_id = m.id AND d.recipient_id = $1)
+    ORDER BY m.id`, recipient[:], channel, key, excluded, since.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// Makes the message the retained value on its channel and key, or clears the retained value.
+func retain(ctx context.Context, tx *sql.Tx, channel, key string, mesId int64, clear bool) error {
+	if clear {
+		_, err := tx.ExecContext(ctx, "DELETE FROM retained WHERE channel = $1 AND key = $2", channel, key)
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO retained (channel, key, message_id) VALUES ($1, $2, $3) ON CONFLICT (channel, key) DO UPDATE SET message_id = excluded.message_id", channel, key, mesId)
+	return err
+}
+
+// Adds a pending delivery to the recipient for every retained value matched by the subscription which isn't already
+// pending for it, returning how many were added. The subscription's channel may be a pattern, and blank channels and
+// keys match anything.
+func DeliverRetained(ctx context.Context, db *sql.DB, recipient uuid.UUID, channel, key string) (int, error) {
+	res, err := db.ExecContext(ctx, `INSERT INTO delivery (message_id, recipient_id, expires_at)
+    SELECT r.message_id, $1, m.expires_at FROM retained r JOIN message m ON m.id = r.message_id
+    WHERE tolliver_match($2, r.channel) AND ($3 = '' OR r.key = $3)
+    AND NOT EXISTS (SELECT 1 FROM delivery d WHERE d.message_id = r.message_id AND d.recipient_id = $1)
+    ORDER BY r.message_id`, recipient[:], channel, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -1,42 +1,104 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/common"
 )
 
 // TODO: check about sqlite enforcing uniqueness constraints and maybe use transaction
 
-func GetSubscriberUUIDs(channel, key string, db *sql.DB) []uuid.UUID {
-	res, err := db.Query("SELECT DISTINCT id FROM subscription WHERE (channel = $1 OR channel = \"\") AND (key = $2 OR key = \"\")", channel, key)
+// Returns the subscriptions of every remote, so they can be indexed in memory for routing messages.
+func GetSubscriptions(ctx context.Context, db *sql.DB) (map[uuid.UUID][]common.SubcriptionInfo, error) {
+	res, err := db.QueryContext(ctx, "SELECT instance_id, channel, key, group_name FROM subscription ORDER BY rowid")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	out := make([]uuid.UUID, 0, 10)
+	defer res.Close()
+
+	out := make(map[uuid.UUID][]common.SubcriptionInfo)
 	for res.Next() {
-		b := make([]byte, 16)
-		res.Scan(&b)
+		var b []byte
+		var s common.SubcriptionInfo
+		if err := res.Scan(&b, &s.Channel, &s.Key, &s.Group); err != nil {
+			return nil, err
+		}
 		id, err := uuid.FromBytes(b)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		out = append(out, id)
+		out[id] = append(out[id], s)
 	}
 
-	return out
+	return out, res.Err()
+}
+
+// Records that the remote with the given UUID is subscribed to the channel key pair, doing nothing if it already is.
+func Subscribe(ctx context.Context, sub common.SubcriptionInfo, id uuid.UUID, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, subscribeQuery, sub.Channel, sub.Key, id[:], sub.Group)
+	return err
 }
 
-func Subscribe(channel, key string, id uuid.UUID, db *sql.DB) {
-	_, err := db.Exec("INSERT INTO subscription (channel, key, id) VALUES ($1, $2, $3)", channel, key, id)
+const subscribeQuery = "INSERT INTO subscription (channel, key, instance_id, group_name) SELECT $1, $2, $3, $4 WHERE NOT EXISTS (SELECT 1 FROM subscription WHERE channel = $1 AND key = $2 AND instance_id = $3 AND group_name = $4)"
+
+// Replaces every subscription recorded for the remote with the given UUID.
+func ReplaceSubscriptions(ctx context.Context, id uuid.UUID, subs []common.SubcriptionInfo, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM subscription WHERE instance_id = $1", id[:]); err != nil {
+		return err
+	}
+	for _, s := range subs {
+		if _, err := tx.ExecContext(ctx, subscribeQuery, s.Channel, s.Key, id[:], s.Group); err != nil {
+			return err
+		}
 	}
+
+	return tx.Commit()
+}
+
+func Unsubscribe(ctx context.Context, sub common.SubcriptionInfo, id uuid.UUID, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM subscription WHERE channel = $1 AND key = $2 AND instance_id = $3 AND group_name = $4", sub.Channel, sub.Key, id[:], sub.Group)
+	return err
 }
 
-func Unsubscribe(channel, key string, id uuid.UUID, db *sql.DB) {
-	_, err := db.Exec("DELETE FROM subscription WHERE channel = $1 AND key = $2 AND id = $3)", channel, key, id)
+// Returns the channel key pairs this instance is subscribed to, in the order they were subscribed.
+func GetLocalSubscriptions(ctx context.Context, db *sql.DB) ([]common.SubcriptionInfo, error) {
+	res, err := db.QueryContext(ctx, "SELECT channel, key, group_name FROM local_subscription ORDER BY rowid")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer res.Close()
+
+	var out []common.SubcriptionInfo
+	for res.Next() {
+		var s common.SubcriptionInfo
+		if err := res.Scan(&s.Channel, &s.Key, &s.Group); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+
+	return out, res.Err()
+}
+
+// Saves a subscription of this instance, returning false if it was already saved.
+func AddLocalSubscription(ctx context.Context, sub common.SubcriptionInfo, db *sql.DB) (bool, error) {
+	res, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO local_subscription (channel, key, group_name) VALUES ($1, $2, $3)", sub.Channel, sub.Key, sub.Group)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func RemoveLocalSubscription(ctx context.Context, sub common.SubcriptionInfo, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM local_subscription WHERE channel = $1 AND key = $2 AND group_name = $3", sub.Channel, sub.Key, sub.Group)
+	return err
 }
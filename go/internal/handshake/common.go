@@ -28,4 +28,5 @@ var (
 	UnexpectedMessageCode = errors.New("Unexpected message code")
 	IncompatibleVersions  = errors.New("Incompatible tolliver version")
 	HandshakeFailed       = errors.New("Handshake failed")
+	HandshakeRejected     = errors.New("Handshake rejected by the remote")
 )
@@ -15,8 +15,10 @@ type handshakeReq struct {
 	Subs    []common.SubcriptionInfo
 }
 
-func AwaitHandshake(conn net.Conn, instanceId uuid.UUID, subscriptions []common.SubcriptionInfo) (uuid.UUID, []common.SubcriptionInfo, error) {
-	r := binary.NewReader(conn)
+// Answers a handshake sent by a dialing instance. Messages are read through r, which must keep being used to read from
+// conn afterwards since it may already have buffered messages the remote sent straight after the handshake. The UUID the
+// remote claims is passed to verify, and if it returns an error the handshake is rejected with a general error.
+func AwaitHandshake(conn net.Conn, r *binary.Reader, instanceId uuid.UUID, subscriptions []common.SubcriptionInfo, verify func(uuid.UUID) error) (uuid.UUID, []common.SubcriptionInfo, error) {
 	req, err := parseHandshakeRequest(r)
 	if err != nil {
 		return uuid.UUID{}, nil, err
@@ -33,7 +35,15 @@ func AwaitHandshake(conn net.Conn, instanceId uuid.UUID, subscriptions []common.
 		code = HandshakeRequestCompatible
 	}
 
-	connections.SendBytes(buildHandshakeRes(instanceId, subscriptions, code), conn)
+	if verifyErr := verify(req.Id); verifyErr != nil {
+		// Don't tell an impostor anything about this instance
+		connections.SendBytes(buildHandshakeRes(uuid.UUID{}, nil, GeneralError), conn)
+		return req.Id, nil, verifyErr
+	}
+
+	if err := connections.SendBytes(buildHandshakeRes(instanceId, subscriptions, code), conn); err != nil {
+		return uuid.UUID{}, nil, err
+	}
 
 	if code == HandshakeRequestCompatible {
 		err := parseHandshakeFinal(r)
@@ -62,6 +72,10 @@ func parseHandshakeRequest(r *binary.Reader) (handshakeReq, error) {
 	if code != HandshakeReqMessageCode {
 		return handshakeReq{}, UnexpectedMessageCode
 	}
+	// Older versions lay out subscriptions differently, and the handshake is rejected without them anyway
+	if version < common.TolliverVersion {
+		return handshakeReq{Version: version, Id: id}, nil
+	}
 	if err := r.ReadSubs(&subs); err != nil {
 		return handshakeReq{}, err
 	}
@@ -16,10 +16,14 @@ type handshakeRes struct {
 	Subs    []common.SubcriptionInfo
 }
 
-func SendTolliverHandshake(conn *tls.Conn, id uuid.UUID, subscriptions []common.SubcriptionInfo) (uuid.UUID, []common.SubcriptionInfo, error) {
-	r := binary.NewReader(conn)
+// Starts a handshake with the instance at the other end of conn. As with AwaitHandshake, r must keep being used to read
+// from conn afterwards, and the UUID the remote claims is passed to verify, which fails the handshake if it returns an
+// error.
+func SendTolliverHandshake(conn *tls.Conn, r *binary.Reader, id uuid.UUID, subscriptions []common.SubcriptionInfo, verify func(uuid.UUID) error) (uuid.UUID, []common.SubcriptionInfo, error) {
 	req := buildHandshakeReq(id, subscriptions)
-	connections.SendBytes(req, conn)
+	if err := connections.SendBytes(req, conn); err != nil {
+		return uuid.UUID{}, nil, err
+	}
 
 	res, err := parseHandshakeResponse(r)
 	if err != nil {
@@ -30,6 +34,10 @@ func SendTolliverHandshake(conn *tls.Conn, id uuid.UUID, subscriptions []common.
 	case HandshakeSuccess:
 		fallthrough
 	case HandshakeBackwardsCompatible:
+		if err := verify(res.Id); err != nil {
+			connections.SendBytes(buildHandshakeFin(HandshakeFinalGeneralError), conn)
+			return res.Id, nil, err
+		}
 		return res.Id, res.Subs, nil
 
 	case HandshakeRequestCompatible:
@@ -38,6 +46,8 @@ func SendTolliverHandshake(conn *tls.Conn, id uuid.UUID, subscriptions []common.
 		fallthrough
 	case HandshakeIncompatible:
 		return res.Id, res.Subs, IncompatibleVersions
+	case GeneralError:
+		return res.Id, res.Subs, HandshakeRejected
 	default:
 		return res.Id, res.Subs, UnexpectedMessageCode
 	}
@@ -71,6 +81,10 @@ func parseHandshakeResponse(r *binary.Reader) (handshakeRes, error) {
 	if code != HandshakeResMessageCode {
 		return handshakeRes{}, UnexpectedMessageCode
 	}
+	// Older versions lay out subscriptions differently, and they will have said the versions are incompatible
+	if version < common.TolliverVersion {
+		return handshakeRes{Status: errorCode, Version: version, Id: id}, nil
+	}
 	if err := r.ReadSubs(&subs); err != nil {
 		return handshakeRes{}, err
 	}
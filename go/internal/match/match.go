@@ -0,0 +1,195 @@
+// Matches hierarchical channel names against subscription patterns.
+//
+// Channel names are split into tokens on '.' and '/', e.g. "vm.eu/shutdown" is the tokens "vm", "eu" and "shutdown"
+// with the separators kept, so "vm.eu.shutdown" is a different channel. In a pattern a token of "*" matches any single
+// token and a final token of ">" matches one or more tokens, so "vm.*.shutdown" matches "vm.eu.shutdown" and "vm.>"
+// matches both "vm.eu" and "vm.eu.shutdown" but not "vm". A blank pattern matches every channel. Anything else must
+// match exactly.
+package match
+
+// Reports whether a channel name is matched by the pattern.
+func Match(pattern, channel string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	p, c := tokens(pattern), tokens(channel)
+	for i, t := range p {
+		if i == len(p)-1 && isMultiWildcard(t) {
+			return len(c) > i && separator(c[i]) == separator(t)
+		}
+		if i >= len(c) {
+			return false
+		}
+		if t != c[i] && !(isWildcard(t) && separator(c[i]) == separator(t)) {
+			return false
+		}
+	}
+	return len(p) == len(c)
+}
+
+// Reports whether every channel matched by the pattern sub is also matched by pattern, so that a subscription to sub
+// asks for nothing pattern doesn't allow. A channel without wildcards is covered exactly when Match reports it matches.
+func Covers(pattern, sub string) bool {
+	if pattern == "" {
+		return true
+	}
+	if sub == "" {
+		return false
+	}
+
+	p, s := tokens(pattern), tokens(sub)
+	for i, t := range p {
+		if i == len(p)-1 && isMultiWildcard(t) {
+			return len(s) > i && separator(s[i]) == separator(t)
+		}
+		if i >= len(s) {
+			return false
+		}
+		if i == len(s)-1 && isMultiWildcard(s[i]) {
+			// Only a final > can cover any number of tokens
+			return false
+		}
+		if t != s[i] && !(isWildcard(t) && separator(s[i]) == separator(t)) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+// Reports whether the name contains a wildcard, and so can only be subscribed to rather than published on.
+func IsPattern(name string) bool {
+	for _, t := range tokens(name) {
+		if isWildcard(t) || isMultiWildcard(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// An index of values by pattern which finds every value whose pattern matches a channel without comparing the channel
+// against each pattern in turn. The zero value is an empty trie ready to use. A Trie isn't safe for concurrent use.
+type Trie[V comparable] struct {
+	root node[V]
+	// Values added with a blank pattern
+	any map[V]struct{}
+}
+
+type node[V comparable] struct {
+	// Keyed by token, including its separator
+	children map[string]*node[V]
+	values   map[V]struct{}
+}
+
+// Adds a value under the pattern, doing nothing if it is already there.
+func (t *Trie[V]) Add(pattern string, v V) {
+	if pattern == "" {
+		if t.any == nil {
+			t.any = make(map[V]struct{})
+		}
+		t.any[v] = struct{}{}
+		return
+	}
+
+	n := &t.root
+	for _, tok := range tokens(pattern) {
+		if n.children == nil {
+			n.children = make(map[string]*node[V])
+		}
+		c := n.children[tok]
+		if c == nil {
+			c = &node[V]{}
+			n.children[tok] = c
+		}
+		n = c
+	}
+	if n.values == nil {
+		n.values = make(map[V]struct{})
+	}
+	n.values[v] = struct{}{}
+}
+
+// Removes a value from under the pattern, doing nothing if it isn't there.
+func (t *Trie[V]) Remove(pattern string, v V) {
+	if pattern == "" {
+		delete(t.any, v)
+		return
+	}
+	t.root.remove(tokens(pattern), v)
+}
+
+// Removes the value and prunes any nodes left empty, returning whether n itself is now empty.
+func (n *node[V]) remove(toks []string, v V) bool {
+	if len(toks) == 0 {
+		delete(n.values, v)
+	} else if c := n.children[toks[0]]; c != nil && c.remove(toks[1:], v) {
+		delete(n.children, toks[0])
+	}
+	return len(n.values) == 0 && len(n.children) == 0
+}
+
+// Returns every value whose pattern matches the channel, each once and in no particular order.
+func (t *Trie[V]) Match(channel string) []V {
+	found := make(map[V]struct{}, len(t.any))
+	for v := range t.any {
+		found[v] = struct{}{}
+	}
+	t.root.match(tokens(channel), found)
+
+	out := make([]V, 0, len(found))
+	for v := range found {
+		out = append(out, v)
+	}
+	return out
+}
+
+func (n *node[V]) match(toks []string, found map[V]struct{}) {
+	if len(toks) == 0 {
+		for v := range n.values {
+			found[v] = struct{}{}
+		}
+		return
+	}
+
+	sep := separator(toks[0])
+	if c := n.children[toks[0]]; c != nil {
+		c.match(toks[1:], found)
+	}
+	if c := n.children[sep+"*"]; c != nil && toks[0] != sep+"*" {
+		c.match(toks[1:], found)
+	}
+	// A > anywhere but at the end of a pattern is an ordinary token, and those patterns have no values on the node
+	if c := n.children[sep+">"]; c != nil {
+		for v := range c.values {
+			found[v] = struct{}{}
+		}
+	}
+}
+
+// Splits a name before each separator, so every token but the first starts with the separator before it.
+func tokens(name string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' || name[i] == '/' {
+			out = append(out, name[start:i])
+			start = i
+		}
+	}
+	return append(out, name[start:])
+}
+
+func separator(tok string) string {
+	if len(tok) > 0 && (tok[0] == '.' || tok[0] == '/') {
+		return tok[:1]
+	}
+	return ""
+}
+
+func isWildcard(tok string) bool {
+	return tok[len(separator(tok)):] == "*"
+}
+
+func isMultiWildcard(tok string) bool {
+	return tok[len(separator(tok)):] == ">"
+}
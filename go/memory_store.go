@@ -0,0 +1,589 @@
+package tolliver
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/match"
+)
+
+// A Store which keeps everything in memory, for tests and instances which don't need anything to survive a restart.
+// Each MemoryStore has its own instance UUID, so a new one is a new instance as far as remotes are concerned.
+type MemoryStore struct {
+	l  sync.Mutex
+	id uuid.UUID
+
+	lastMessage uint64
+	messages    map[uint64]*StoredMessage
+	deliveries  map[memDeliveryKey]*memDelivery
+	// Last sequence number given out to each recipient per channel key pair
+	sequences map[memSequenceKey]uint64
+	// Id of the retained message per channel key pair
+	retained map[Subscription]uint64
+
+	lastDeadLetter uint64
+	deadLetters    map[uint64]*memDeadLetter
+
+	subscriptions *subscriberIndex
+	local         []Subscription
+	inbox         map[inboxKey]time.Time
+	pins          map[pinKey]struct{}
+}
+
+type memSequenceKey struct {
+	channel   string
+	key       string
+	recipient uuid.UUID
+}
+
+type pinKey struct {
+	remote      uuid.UUID
+	fingerprint Fingerprint
+}
+
+type memDeliveryKey struct {
+	mesId     uint64
+	recipient uuid.UUID
+}
+
+type memDelivery struct {
+	attempts int
+	next     time.Time
+	group    string
+	seq      uint64
+	// Starts as the message's expiry, but is lifted for this delivery alone when it is requeued
+	expiresAt time.Time
+}
+
+type memDeadLetter struct {
+	mesId     uint64
+	recipient uuid.UUID
+	reason    DeadLetterReason
+	detail    string
+	attempts  int
+	deadAt    time.Time
+	group     string
+	seq       uint64
+	expiresAt time.Time
+}
+
+// Creates an empty store with a newly generated instance UUID.
+func NewMemoryStore() (*MemoryStore, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStore{
+		id:            id,
+		messages:      make(map[uint64]*StoredMessage),
+		deliveries:    make(map[memDeliveryKey]*memDelivery),
+		sequences:     make(map[memSequenceKey]uint64),
+		retained:      make(map[Subscription]uint64),
+		deadLetters:   make(map[uint64]*memDeadLetter),
+		subscriptions: newSubscriberIndex(),
+		inbox:         make(map[inboxKey]time.Time),
+		pins:          make(map[pinKey]struct{}),
+	}, nil
+}
+
+func (s *MemoryStore) InstanceID(ctx context.Context) (uuid.UUID, error) {
+	return s.id, nil
+}
+
+func (s *MemoryStore) SaveMessage(ctx context.Context, m StoredMessage, recipients []Recipient) (uint64, []uint64, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.lastMessage++
+	id := s.lastMessage
+	stored := m
+	stored.Body = slices.Clone(m.Body)
+	stored.Headers = maps.Clone(m.Headers)
+	s.messages[id] = &stored
+
+	var seqs []uint64
+	for _, r := range recipients {
+		d := &memDelivery{group: r.Group, expiresAt: m.ExpiresAt}
+		if m.Ordered {
+			d.seq = s.nextSeq(m.Channel, m.Key, r.Remote)
+			seqs = append(seqs, d.seq)
+		}
+		s.deliveries[memDeliveryKey{mesId: id, recipient: r.Remote}] = d
+	}
+
+	if m.Retain {
+		k := Subscription{Channel: m.Channel, Key: m.Key}
+		if len(m.Body) == 0 {
+			delete(s.retained, k)
+		} else {
+			s.retained[k] = id
+		}
+	}
+
+	return id, seqs, nil
+}
+
+func (s *MemoryStore) nextSeq(channel, key string, recipient uuid.UUID) uint64 {
+	k := memSequenceKey{channel: channel, key: key, recipient: recipient}
+	s.sequences[k]++
+	return s.sequences[k]
+}
+
+func (s *MemoryStore) Ack(ctx context.Context, mesId uint64, recipient uuid.UUID) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.deliveries, memDeliveryKey{mesId: mesId, recipient: recipient})
+	return nil
+}
+
+func (s *MemoryStore) DueDeliveries(ctx context.Context, now time.Time, recipients []uuid.UUID) ([]StoredDelivery, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.collect(func(k memDeliveryKey, d *memDelivery) bool {
+		return !d.next.After(now) && slices.Contains(recipients, k.recipient)
+	}), nil
+}
+
+func (s *MemoryStore) PendingDeliveries(ctx context.Context, recipient uuid.UUID) ([]StoredDelivery, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.collect(func(k memDeliveryKey, d *memDelivery) bool {
+		return k.recipient == recipient
+	}), nil
+}
+
+func (s *MemoryStore) DueGroupDeliveries(ctx context.Context, now time.Time) ([]StoredDelivery, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.collect(func(k memDeliveryKey, d *memDelivery) bool {
+		return d.group != "" && !d.next.After(now)
+	}), nil
+}
+
+func (s *MemoryStore) Reassign(ctx context.Context, mesId uint64, from, to uuid.UUID) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	k := memDeliveryKey{mesId: mesId, recipient: from}
+	d := s.deliveries[k]
+	if d == nil || s.deliveries[memDeliveryKey{mesId: mesId, recipient: to}] != nil {
+		return false, nil
+	}
+	delete(s.deliveries, k)
+	d.next = time.Time{}
+	if d.seq != 0 {
+		m := s.messages[mesId]
+		d.seq = s.nextSeq(m.Channel, m.Key, to)
+	}
+	s.deliveries[memDeliveryKey{mesId: mesId, recipient: to}] = d
+	return true, nil
+}
+
+// Returns the deliveries matching the filter, oldest message first. Must be called with s.l held.
+func (s *MemoryStore) collect(match func(memDeliveryKey, *memDelivery) bool) []StoredDelivery {
+	var out []StoredDelivery
+	for k, d := range s.deliveries {
+		if match(k, d) {
+			out = append(out, s.delivery(k, d))
+		}
+	}
+	slices.SortFunc(out, func(a, b StoredDelivery) int {
+		return cmp.Or(cmp.Compare(a.MessageID, b.MessageID), slices.Compare(a.Recipient[:], b.Recipient[:]))
+	})
+	return out
+}
+
+func (s *MemoryStore) delivery(k memDeliveryKey, d *memDelivery) StoredDelivery {
+	m := s.messages[k.mesId]
+	return StoredDelivery{
+		MessageID: k.mesId,
+		Recipient: k.recipient,
+		Channel:   m.Channel,
+		Key:       m.Key,
+		Body:      m.Body,
+		Headers:   m.Headers,
+		Attempts:  d.attempts,
+		ExpiresAt: d.expiresAt,
+		Seq:       d.seq,
+		Group:     d.group,
+	}
+}
+
+func (s *MemoryStore) Replay(ctx context.Context, recipient uuid.UUID, channel, key string, since time.Time) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	added := 0
+	for id, m := range s.messages {
+		k := memDeliveryKey{mesId: id, recipient: recipient}
+		if !match.Match(channel, m.Channel) || (key != "" && m.Key != key) || m.Channel == ReservedTolliverChannel ||
+			m.SavedAt.Before(since) || s.deliveries[k] != nil {
+			continue
+		}
+		s.deliveries[k] = &memDelivery{expiresAt: m.ExpiresAt}
+		added++
+	}
+	return added, nil
+}
+
+func (s *MemoryStore) DeliverRetained(ctx context.Context, recipient uuid.UUID, channel, key string) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	added := 0
+	for sub, id := range s.retained {
+		k := memDeliveryKey{mesId: id, recipient: recipient}
+		if !match.Match(channel, sub.Channel) || (key != "" && sub.Key != key) || s.deliveries[k] != nil {
+			continue
+		}
+		s.deliveries[k] = &memDelivery{expiresAt: s.messages[id].ExpiresAt}
+		added++
+	}
+	return added, nil
+}
+
+func (s *MemoryStore) RecordAttempt(ctx context.Context, mesId uint64, recipient uuid.UUID, at, next time.Time) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if d := s.deliveries[memDeliveryKey{mesId: mesId, recipient: recipient}]; d != nil {
+		d.attempts++
+		d.next = next
+	}
+	return nil
+}
+
+func (s *MemoryStore) FirstPendingSeq(ctx context.Context, channel, key string, recipient uuid.UUID) (uint64, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var first uint64
+	for k, d := range s.deliveries {
+		m := s.messages[k.mesId]
+		if k.recipient != recipient || d.seq == 0 || m.Channel != channel || m.Key != key {
+			continue
+		}
+		if first == 0 || d.seq < first {
+			first = d.seq
+		}
+	}
+	return first, nil
+}
+
+func (s *MemoryStore) ExpireDeliveries(ctx context.Context, now time.Time) ([]DeadLetter, error) {
+	return s.deadLetter(func(k memDeliveryKey, d *memDelivery) bool {
+		return !d.expiresAt.IsZero() && !d.expiresAt.After(now)
+	}, DeadLetterExpired, "", now), nil
+}
+
+func (s *MemoryStore) ExhaustDeliveries(ctx context.Context, maxAttempts int, now time.Time) ([]DeadLetter, error) {
+	return s.deadLetter(func(k memDeliveryKey, d *memDelivery) bool {
+		return d.attempts >= maxAttempts && !d.next.After(now)
+	}, DeadLetterMaxAttempts, "", now), nil
+}
+
+func (s *MemoryStore) Reject(ctx context.Context, mesId uint64, recipient uuid.UUID, detail string, now time.Time) ([]DeadLetter, error) {
+	return s.deadLetter(func(k memDeliveryKey, d *memDelivery) bool {
+		return k.mesId == mesId && k.recipient == recipient
+	}, DeadLetterRejected, detail, now), nil
+}
+
+func (s *MemoryStore) deadLetter(match func(memDeliveryKey, *memDelivery) bool, reason DeadLetterReason, detail string, now time.Time) []DeadLetter {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var out []DeadLetter
+	for _, d := range s.collect(match) {
+		k := memDeliveryKey{mesId: d.MessageID, recipient: d.Recipient}
+		delete(s.deliveries, k)
+
+		s.lastDeadLetter++
+		l := &memDeadLetter{mesId: d.MessageID, recipient: d.Recipient, reason: reason, detail: detail, attempts: d.Attempts, deadAt: now, group: d.Group, seq: d.Seq, expiresAt: d.ExpiresAt}
+		s.deadLetters[s.lastDeadLetter] = l
+		out = append(out, s.toDeadLetter(s.lastDeadLetter, l))
+	}
+	return out
+}
+
+func (s *MemoryStore) toDeadLetter(id uint64, l *memDeadLetter) DeadLetter {
+	m := s.messages[l.mesId]
+	return DeadLetter{
+		ID:        id,
+		MessageID: l.mesId,
+		Recipient: l.recipient,
+		Channel:   m.Channel,
+		Key:       m.Key,
+		Body:      m.Body,
+		Headers:   m.Headers,
+		ExpiresAt: l.expiresAt,
+		Reason:    l.reason,
+		Detail:    l.detail,
+		Attempts:  l.attempts,
+		DeadAt:    l.deadAt,
+	}
+}
+
+func (s *MemoryStore) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var out []DeadLetter
+	for id, l := range s.deadLetters {
+		dl := s.toDeadLetter(id, l)
+		if (filter.Channel != "" && dl.Channel != filter.Channel) ||
+			(filter.Key != "" && dl.Key != filter.Key) ||
+			(filter.Recipient != uuid.Nil && dl.Recipient != filter.Recipient) ||
+			(filter.Reason != "" && dl.Reason != filter.Reason) {
+			continue
+		}
+		out = append(out, dl)
+	}
+	slices.SortFunc(out, func(a, b DeadLetter) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if filter.Limit > 0 && len(out) > filter.Limit {
+		out = out[:filter.Limit]
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) Requeue(ctx context.Context, id uint64, now time.Time) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	l := s.deadLetters[id]
+	if l == nil {
+		return false, nil
+	}
+
+	m := s.messages[l.mesId]
+	d := &memDelivery{group: l.group, expiresAt: l.expiresAt}
+	if !d.expiresAt.IsZero() && !d.expiresAt.After(now) {
+		d.expiresAt = time.Time{}
+	}
+	if l.seq != 0 {
+		d.seq = s.nextSeq(m.Channel, m.Key, l.recipient)
+	}
+	s.deliveries[memDeliveryKey{mesId: l.mesId, recipient: l.recipient}] = d
+	delete(s.deadLetters, id)
+	return true, nil
+}
+
+func (s *MemoryStore) PurgeDeadLetter(ctx context.Context, id uint64) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	l := s.deadLetters[id]
+	if l == nil {
+		return false, nil
+	}
+	delete(s.deadLetters, id)
+	return true, nil
+}
+
+func (s *MemoryStore) Subscribers(ctx context.Context, channel, key string) ([]uuid.UUID, error) {
+	return s.subscriptions.match(channel, key), nil
+}
+
+func (s *MemoryStore) Groups(ctx context.Context, channel, key string) (map[string][]uuid.UUID, error) {
+	return s.subscriptions.groups(channel, key), nil
+}
+
+func (s *MemoryStore) AddSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error {
+	s.subscriptions.add(remote, sub)
+	return nil
+}
+
+func (s *MemoryStore) RemoveSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error {
+	s.subscriptions.remove(remote, sub)
+	return nil
+}
+
+func (s *MemoryStore) ReplaceSubscriptions(ctx context.Context, remote uuid.UUID, subs []Subscription) error {
+	s.subscriptions.replace(remote, subs)
+	return nil
+}
+
+func (s *MemoryStore) LocalSubscriptions(ctx context.Context) ([]Subscription, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return slices.Clone(s.local), nil
+}
+
+func (s *MemoryStore) AddLocalSubscription(ctx context.Context, sub Subscription) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if slices.Contains(s.local, sub) {
+		return false, nil
+	}
+	s.local = append(s.local, sub)
+	return true, nil
+}
+
+func (s *MemoryStore) RemoveLocalSubscription(ctx context.Context, sub Subscription) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.local = slices.DeleteFunc(s.local, func(l Subscription) bool {
+		return l == sub
+	})
+	return nil
+}
+
+func (s *MemoryStore) Processed(ctx context.Context, sender uuid.UUID, mesId uint64) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	_, ok := s.inbox[inboxKey{sender: sender, id: mesId}]
+	return ok, nil
+}
+
+func (s *MemoryStore) MarkProcessed(ctx context.Context, sender uuid.UUID, mesId uint64, at time.Time) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.inbox[inboxKey{sender: sender, id: mesId}] = at
+	return nil
+}
+
+func (s *MemoryStore) PruneInbox(ctx context.Context, before time.Time) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	maps.DeleteFunc(s.inbox, func(k inboxKey, at time.Time) bool {
+		return at.Before(before)
+	})
+	return nil
+}
+
+func (s *MemoryStore) PinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.pins[pinKey{remote: remote, fingerprint: fingerprint}] = struct{}{}
+	return nil
+}
+
+func (s *MemoryStore) UnpinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	k := pinKey{remote: remote, fingerprint: fingerprint}
+	_, ok := s.pins[k]
+	delete(s.pins, k)
+	return ok, nil
+}
+
+func (s *MemoryStore) CertificatePinned(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	_, ok := s.pins[pinKey{remote: remote, fingerprint: fingerprint}]
+	return ok, nil
+}
+
+func (s *MemoryStore) DeleteUnreferenced(ctx context.Context, savedBefore time.Time, channels map[string]time.Time) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	referenced := make(map[uint64]bool)
+	for k := range s.deliveries {
+		referenced[k.mesId] = true
+	}
+	for _, l := range s.deadLetters {
+		referenced[l.mesId] = true
+	}
+	for _, id := range s.retained {
+		referenced[id] = true
+	}
+
+	deleted := 0
+	for id, m := range s.messages {
+		before, ok := channels[m.Channel]
+		if !ok {
+			before = savedBefore
+		}
+		if !referenced[id] && m.SavedAt.Before(before) {
+			delete(s.messages, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) Usage(ctx context.Context) (StoreUsage, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.usage(), nil
+}
+
+// Must be called with s.l held.
+func (s *MemoryStore) usage() StoreUsage {
+	var u StoreUsage
+	for _, m := range s.messages {
+		if m.Channel == ReservedTolliverChannel {
+			continue
+		}
+		u.Messages++
+		u.Bytes += int64(len(m.Body))
+	}
+	return u
+}
+
+func (s *MemoryStore) DropOldest(ctx context.Context, limits StoreUsage) ([]StoredDelivery, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	u := s.usage()
+	over := func() bool {
+		return (limits.Messages > 0 && u.Messages > limits.Messages) || (limits.Bytes > 0 && u.Bytes > limits.Bytes)
+	}
+
+	var dropped []StoredDelivery
+	for _, id := range slices.Sorted(maps.Keys(s.messages)) {
+		if !over() {
+			break
+		}
+		if s.messages[id].Channel == ReservedTolliverChannel {
+			continue
+		}
+
+		dropped = append(dropped, s.collect(func(k memDeliveryKey, d *memDelivery) bool {
+			return k.mesId == id
+		})...)
+		maps.DeleteFunc(s.deliveries, func(k memDeliveryKey, d *memDelivery) bool {
+			return k.mesId == id
+		})
+		maps.DeleteFunc(s.deadLetters, func(_ uint64, l *memDeadLetter) bool {
+			return l.mesId == id
+		})
+		maps.DeleteFunc(s.retained, func(_ Subscription, retainedId uint64) bool {
+			return retainedId == id
+		})
+		u.Messages--
+		u.Bytes -= int64(len(s.messages[id].Body))
+		delete(s.messages, id)
+	}
+	return dropped, nil
+}
+
+func (s *MemoryStore) Compact(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
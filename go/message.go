@@ -0,0 +1,360 @@
+package tolliver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/connections"
+)
+
+// A message received from a remote instance, as passed to handlers registered with Instance.RegisterHandler.
+type Message struct {
+	// The channel and key the message was sent on. These are always the concrete values the sender used, even when the
+	// handler was registered with a wildcard.
+	Channel string
+	Key     string
+
+	Body []byte
+
+	// UUID of the instance which sent the message
+	Sender uuid.UUID
+
+	// The sender's local id for the message. Unreliable messages all have an id of 0, and reliable messages may be
+	// received more than once with the same id if an ack is lost.
+	ID uint64
+
+	// Whether the sender will keep resending the message until it is acked
+	Reliable bool
+
+	// When this instance read the message off the connection
+	ReceivedAt time.Time
+
+	// Metadata set by the sender with WithHeader. Names starting with "tolliver-" are reserved for the protocol.
+	Headers map[string]string
+
+	// When the sender stops trying to deliver the message, zero if it never expires. Messages which have already
+	// expired when they arrive are discarded rather than passed to handlers.
+	ExpiresAt time.Time
+
+	// Position of the message among those the sender sent on the same channel and key with Ordered, 0 for messages
+	// which weren't sent in order
+	Sequence uint64
+
+	inst *Instance
+	conn net.Conn
+	// Set for ordered messages, which hold up the rest of their stream until they are settled
+	stream *orderedStream
+	// Set when deduplication is enabled and the message was new, so copies of it are dropped until it is settled
+	tracked bool
+
+	l       sync.Mutex
+	settled bool
+	// Set when a handler took ownership of the message, in which case the instance stays draining until it is settled
+	owned bool
+}
+
+// Processes a message received on a channel key pair. Returning nil means the message was processed and can be acked,
+// while returning an error leaves it unacked so the sender will deliver it again later.
+//
+// A handler can instead take ownership of the message by returning ErrManualAck, after which the message is only
+// settled when Message.Ack or Message.Nack is called, possibly from another goroutine. Handlers may also call Ack or
+// Nack themselves before returning, in which case the return value no longer affects the message.
+type Handler func(ctx context.Context, m *Message) error
+
+var (
+	// Returned by a handler to say it will call Message.Ack or Message.Nack itself
+	ErrManualAck = errors.New("The handler will ack or nack the message itself")
+	// Returned by Message.Ack and Message.Nack if the message has already been acked or nacked
+	ErrAlreadySettled = errors.New("The message has already been acked or nacked")
+)
+
+// Tells the sender the message was processed successfully, so it will stop resending it. This does nothing for
+// unreliable messages.
+func (m *Message) Ack() error {
+	return m.settle(AckSuccess, "")
+}
+
+// Tells the sender the message was rejected and will never be processed by this instance, as opposed to not having
+// been processed yet. The sender stops resending the message, moves it to its dead letter queue and reports the reason
+// through InstanceOptions.OnRejected.
+func (m *Message) Nack(reason string) error {
+	return m.settle(AckError, reason)
+}
+
+func (m *Message) settle(status byte, reason string) error {
+	m.l.Lock()
+	if m.settled {
+		m.l.Unlock()
+		return ErrAlreadySettled
+	}
+	m.settled = true
+	owned := m.owned
+	m.l.Unlock()
+
+	if owned {
+		defer m.inst.inflight.Done()
+	}
+	if m.stream != nil {
+		defer m.inst.advance(m)
+	}
+	if m.tracked {
+		defer m.inst.untrack(m)
+		if status == AckSuccess {
+			m.inst.markProcessed(m)
+		}
+	}
+
+	// 0 is the message ID for unreliable messages
+	if m.ID == 0 || m.conn == nil {
+		return nil
+	}
+	return connections.SendBytes(buildAck(status, m.ID, reason), m.conn)
+}
+
+// Reported when a remote nacks a reliable message this instance sent to it
+type Rejection struct {
+	Recipient uuid.UUID
+	MessageID uint64
+	Reason    string
+	// Whether the recipient's Authorizer refused the message, rather than the recipient failing to process it
+	Denied bool
+}
+
+type handlerEntry struct {
+	channel string
+	key     string
+	handler Handler
+}
+
+// Returned by handlers adapted from the callbacks passed to Register when the callback returns false
+var errNotProcessed = errors.New("callback did not process the message")
+
+const (
+	reservedHeaderPrefix = "tolliver-"
+	// Unix milliseconds after which the message should be discarded
+	expiresHeader = reservedHeaderPrefix + "expires"
+	// Sequence number of an ordered message among those to the receiver on its channel and key
+	seqHeader = reservedHeaderPrefix + "seq"
+	// Lowest sequence number the sender still has to deliver to the receiver on the channel and key, anything before it
+	// was either acked or given up on
+	seqFirstHeader = reservedHeaderPrefix + "seq-first"
+)
+
+var ErrReservedHeader = errors.New("Header names starting with tolliver- are reserved for protocol use")
+
+// Configures a single call to Send or UnreliableSend
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	headers   map[string]string
+	expiresAt time.Time
+	ordered   bool
+	retain    bool
+
+	// Called with the id and recipients of a reliable message once it has been saved, before it is sent
+	onSaved func(id uint64, recipients []uuid.UUID)
+}
+
+// Attaches a header to the message, which receivers can read from Message.Headers. Sending fails with
+// ErrReservedHeader if the name starts with "tolliver-".
+func WithHeader(name, value string) SendOption {
+	return func(o *sendOptions) {
+		if o.headers == nil {
+			o.headers = make(map[string]string)
+		}
+		o.headers[name] = value
+	}
+}
+
+// Stops trying to deliver the message once ttl has passed. Undelivered copies are moved to the dead letter queue by the
+// retry loop and reported through InstanceOptions.OnExpired, and receivers discard the message if it arrives late.
+func WithTTL(ttl time.Duration) SendOption {
+	return WithDeadline(time.Now().Add(ttl))
+}
+
+// Stops trying to deliver the message after the given time, see WithTTL.
+func WithDeadline(deadline time.Time) SendOption {
+	return func(o *sendOptions) {
+		o.expiresAt = deadline
+	}
+}
+
+// Delivers the message to each recipient's handlers only after every message sent to that recipient before it with
+// Ordered on the same channel and key has been acked or nacked, or has been given up on by this instance. Only applies
+// to reliable messages.
+//
+// Later messages are held by the recipient while it waits for an earlier one, so they may be resent a few times in the
+// meantime and count towards InstanceOptions.MaxAttempts.
+func Ordered() SendOption {
+	return func(o *sendOptions) {
+		o.ordered = true
+	}
+}
+
+// Makes the message the retained value on its channel and key, replacing the previous one. Remotes are sent the
+// retained values matching their subscriptions whenever they connect or subscribe, so they learn the latest value
+// without waiting for the next one to be sent. Sending an empty body with Retain clears the retained value.
+func Retain() SendOption {
+	return func(o *sendOptions) {
+		o.retain = true
+	}
+}
+
+func buildSendOptions(opts []SendOption) (sendOptions, error) {
+	var out sendOptions
+	for _, o := range opts {
+		o(&out)
+	}
+
+	for name := range out.headers {
+		if strings.HasPrefix(name, reservedHeaderPrefix) {
+			return out, ErrReservedHeader
+		}
+	}
+
+	return out, nil
+}
+
+// Adds the protocol headers for the message's expiry and, for ordered messages, its place in the stream to the headers
+// set by the application.
+func wireHeaders(headers map[string]string, expiresAt time.Time, seq, first uint64) map[string]string {
+	if expiresAt.IsZero() && seq == 0 {
+		return headers
+	}
+
+	out := make(map[string]string, len(headers)+3)
+	for k, v := range headers {
+		out[k] = v
+	}
+	if !expiresAt.IsZero() {
+		out[expiresHeader] = strconv.FormatInt(expiresAt.UnixMilli(), 10)
+	}
+	if seq != 0 {
+		out[seqHeader] = strconv.FormatUint(seq, 10)
+		if first != 0 {
+			out[seqFirstHeader] = strconv.FormatUint(first, 10)
+		}
+	}
+	return out
+}
+
+// Reported when an instance gives up delivering a reliable message because it expired before being acked
+type Expiry struct {
+	Recipient uuid.UUID
+	MessageID uint64
+	Channel   string
+	Key       string
+	ExpiredAt time.Time
+}
+
+// Passes a message read off a connection to the handlers, unless it has expired, is a reply to a request or has to wait
+// for earlier messages in its ordered stream.
+func (inst *Instance) dispatch(m *Message) {
+	m.inst = inst
+	if ms, err := strconv.ParseInt(m.Headers[expiresHeader], 10, 64); err == nil {
+		m.ExpiresAt = time.UnixMilli(ms)
+	}
+	if !m.ExpiresAt.IsZero() && m.ReceivedAt.After(m.ExpiresAt) {
+		m.Nack("expired")
+		return
+	}
+	if inst.routeReply(m) {
+		return
+	}
+	if inst.duplicate(m) {
+		return
+	}
+
+	if seq, err := strconv.ParseUint(m.Headers[seqHeader], 10, 64); err == nil && seq != 0 && m.Reliable {
+		m.Sequence = seq
+		first, _ := strconv.ParseUint(m.Headers[seqFirstHeader], 10, 64)
+		if m = inst.accept(m, first); m == nil {
+			return
+		}
+	}
+
+	inst.handle(m)
+}
+
+// Runs every handler registered on a matching channel key pair, then acks the message if they all succeeded and none
+// of them took ownership of it.
+func (inst *Instance) handle(m *Message) {
+	inst.l.RLock()
+	if inst.closed {
+		// The instance is draining, so leave the message unacked for the sender to retry later
+		inst.l.RUnlock()
+		inst.unsettled(m)
+		return
+	}
+	inst.inflight.Add(1)
+
+	// Handlers run in the order they were registered
+	matched := inst.handlerIndex.Match(m.Channel)
+	slices.Sort(matched)
+	var handlers []Handler
+	for _, i := range matched {
+		if h := inst.handlers[i]; h.key == m.Key || h.key == "" {
+			handlers = append(handlers, h.handler)
+		}
+	}
+	inst.l.RUnlock()
+
+	shouldAck := true
+	manual := false
+	for _, h := range handlers {
+		err := h(inst.ctx, m)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrManualAck):
+			manual = true
+		case errors.Is(err, errNotProcessed):
+			shouldAck = false
+		default:
+			inst.logger.Warn("Handler failed to process message", "channel", m.Channel, "key", m.Key, "sender", m.Sender.String(), "err", err)
+			shouldAck = false
+		}
+	}
+
+	m.l.Lock()
+	if manual && !m.settled {
+		// Whoever calls Ack or Nack finishes the in flight work
+		m.owned = true
+		m.l.Unlock()
+		return
+	}
+	m.l.Unlock()
+	defer inst.inflight.Done()
+
+	if shouldAck && !manual {
+		if err := m.Ack(); err != nil && !errors.Is(err, ErrAlreadySettled) {
+			inst.logger.Warn("Failed to send ack", "message", m.ID, "remote", m.Sender.String(), "err", err)
+		}
+	} else {
+		inst.unsettled(m)
+	}
+}
+
+// Cleans up after handlers which left m unsettled without taking ownership of it, so that it can be processed again when
+// the sender resends it.
+func (inst *Instance) unsettled(m *Message) {
+	m.l.Lock()
+	settled := m.settled
+	m.l.Unlock()
+	if settled {
+		return
+	}
+
+	if m.stream != nil {
+		inst.release(m)
+	}
+	if m.tracked {
+		inst.untrack(m)
+	}
+}
@@ -0,0 +1,140 @@
+package tolliver
+
+import (
+	"github.com/google/uuid"
+)
+
+// Most messages held per ordered stream while waiting for an earlier one. Any more are dropped unacked, and the sender
+// resends them later.
+const maxReorderBuffer = 1024
+
+type streamKey struct {
+	sender  uuid.UUID
+	channel string
+	key     string
+}
+
+// Tracks the ordered messages received from one sender on one channel key pair.
+type orderedStream struct {
+	// Sequence number of the next message to pass to the handlers
+	next uint64
+	// Whether the message with sequence number next is currently with the handlers
+	busy bool
+	// Messages which arrived before their turn, by sequence number
+	buffered map[uint64]*Message
+}
+
+// Decides what to do with an ordered message that has just arrived. Messages the stream has already moved past are
+// acked straight away since their handlers already ran, and messages which arrived early are buffered. Returns the
+// message which should be passed to the handlers next, which isn't necessarily m, or nil if there isn't one.
+//
+// first is the lowest sequence number the sender is still trying to deliver, so a new stream starts there and a stream
+// can skip over messages the sender has given up on. It is 0 if the sender didn't say.
+func (inst *Instance) accept(m *Message, first uint64) *Message {
+	inst.orderL.Lock()
+
+	k := streamKey{sender: m.Sender, channel: m.Channel, key: m.Key}
+	if inst.streams == nil {
+		inst.streams = make(map[streamKey]*orderedStream)
+	}
+	s := inst.streams[k]
+	if s == nil {
+		// An earlier message may still be on its way, e.g. when a new send overtakes messages being flushed after a
+		// reconnect, so start from where the sender says it is delivering from
+		start := m.Sequence
+		if first != 0 && first < start {
+			start = first
+		}
+		s = &orderedStream{next: start, buffered: make(map[uint64]*Message)}
+		inst.streams[k] = s
+	}
+	var dropped []*Message
+	if first > s.next {
+		s.next = first
+		s.busy = false
+		for seq, b := range s.buffered {
+			if seq < first {
+				delete(s.buffered, seq)
+				dropped = append(dropped, b)
+			}
+		}
+	}
+
+	var next *Message
+	switch {
+	case m.Sequence < s.next:
+		inst.orderL.Unlock()
+		inst.untrackDropped(dropped)
+		// The ack must have been lost, so the sender resent it
+		m.Ack()
+		return nil
+	case m.Sequence == s.next && !s.busy:
+		s.busy = true
+		m.stream = s
+		next = m
+	case m.Sequence > s.next && len(s.buffered) < maxReorderBuffer:
+		s.buffered[m.Sequence] = m
+		next = s.take()
+	default:
+		// Left unacked for the sender to resend, so the copy it resends mustn't be taken for a duplicate
+		dropped = append(dropped, m)
+	}
+	inst.orderL.Unlock()
+	inst.untrackDropped(dropped)
+
+	return next
+}
+
+// Stops tracking messages which the stream dropped without passing to the handlers.
+func (inst *Instance) untrackDropped(dropped []*Message) {
+	for _, m := range dropped {
+		if m.tracked {
+			inst.untrack(m)
+		}
+	}
+}
+
+// Moves the stream of a settled message on to the next one, passing it to the handlers if it has already arrived.
+func (inst *Instance) advance(m *Message) {
+	inst.orderL.Lock()
+	s := m.stream
+	if s.next != m.Sequence {
+		inst.orderL.Unlock()
+		return
+	}
+	s.next++
+	s.busy = false
+	next := s.take()
+	inst.orderL.Unlock()
+
+	if next != nil {
+		go inst.handle(next)
+	}
+}
+
+// Lets the stream of a message its handlers failed to process accept the message again when the sender resends it.
+func (inst *Instance) release(m *Message) {
+	inst.orderL.Lock()
+	defer inst.orderL.Unlock()
+
+	if m.stream.next == m.Sequence {
+		m.stream.busy = false
+	}
+}
+
+// Removes and returns the buffered message whose turn it is, if the handlers are free. Must be called with
+// Instance.orderL held.
+func (s *orderedStream) take() *Message {
+	if s.busy {
+		return nil
+	}
+	m := s.buffered[s.next]
+	if m == nil {
+		return nil
+	}
+
+	delete(s.buffered, s.next)
+	s.busy = true
+	m.stream = s
+	return m
+}
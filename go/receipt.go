@@ -0,0 +1,182 @@
+package tolliver
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Where a reliable message is in being delivered to a single recipient
+type DeliveryState int
+
+const (
+	// The recipient hasn't acked the message yet, and it will keep being resent
+	DeliveryPending DeliveryState = iota
+	DeliveryAcked
+	// The recipient nacked the message
+	DeliveryRejected
+	// The message was moved to the dead letter queue because it expired or ran out of attempts
+	DeliveryDeadLettered
+	// The message was deleted to keep the store within its quota, see OverflowDropOldest
+	DeliveryDropped
+)
+
+type RecipientStatus struct {
+	State DeliveryState
+	// The recipient's reason for a rejection, or the dead letter reason
+	Reason string
+}
+
+// The outcome of a reliable message sent with SendAndWait, per recipient.
+type DeliveryReceipt struct {
+	MessageID  uint64
+	Recipients map[uuid.UUID]RecipientStatus
+}
+
+// Reports whether every recipient acked the message. This is false if there were no recipients.
+func (r *DeliveryReceipt) AllAcked() bool {
+	if len(r.Recipients) == 0 {
+		return false
+	}
+	for _, s := range r.Recipients {
+		if s.State != DeliveryAcked {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	ErrNoRecipients   = errors.New("No remotes are subscribed to the channel and key")
+	ErrDeliveryFailed = errors.New("The message was rejected, dead lettered or dropped for at least one recipient")
+)
+
+type pendingReceipt struct {
+	l         sync.Mutex
+	statuses  map[uuid.UUID]RecipientStatus
+	remaining int
+	done      chan struct{}
+}
+
+// Sends a reliable message like Send, then waits until every recipient subscribed at the time of sending has either
+// acked it, rejected it or had it dead lettered. The returned receipt holds the state for each recipient.
+//
+// The error is nil only if every recipient acked the message. ErrNoRecipients is returned if no remote was subscribed,
+// ErrDeliveryFailed if any recipient rejected the message or it was dead lettered or dropped, and the context's error
+// if it was done first. In the last case the message is still delivered in the background as if it had been sent with
+// Send.
+func (inst *Instance) SendAndWait(ctx context.Context, channel, key string, mes []byte, opts ...SendOption) (*DeliveryReceipt, error) {
+	if err := checkSendChannel(channel); err != nil {
+		return nil, err
+	}
+	o, err := buildSendOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var id uint64
+	var recipients int
+	pending := &pendingReceipt{done: make(chan struct{})}
+	// Register the receipt before the message goes out so that a fast ack isn't missed
+	o.onSaved = func(mesId uint64, ids []uuid.UUID) {
+		id = mesId
+		pending.statuses = make(map[uuid.UUID]RecipientStatus, len(ids))
+		for _, r := range ids {
+			pending.statuses[r] = RecipientStatus{State: DeliveryPending}
+		}
+		pending.remaining = len(pending.statuses)
+		recipients = pending.remaining
+
+		inst.l.Lock()
+		if inst.receipts == nil {
+			inst.receipts = make(map[uint64]*pendingReceipt)
+		}
+		inst.receipts[mesId] = pending
+		inst.l.Unlock()
+	}
+	defer func() {
+		inst.l.Lock()
+		delete(inst.receipts, id)
+		inst.l.Unlock()
+	}()
+
+	if err := inst.send(ctx, mes, channel, key, true, o); err != nil {
+		return nil, err
+	}
+
+	receipt := &DeliveryReceipt{MessageID: id}
+	if recipients == 0 {
+		receipt.Recipients = map[uuid.UUID]RecipientStatus{}
+		return receipt, ErrNoRecipients
+	}
+
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+	}
+
+	pending.l.Lock()
+	receipt.Recipients = maps.Clone(pending.statuses)
+	pending.l.Unlock()
+
+	if err := ctx.Err(); err != nil && !receipt.settled() {
+		return receipt, err
+	}
+	if !receipt.AllAcked() {
+		return receipt, ErrDeliveryFailed
+	}
+	return receipt, nil
+}
+
+func (r *DeliveryReceipt) settled() bool {
+	for _, s := range r.Recipients {
+		if s.State == DeliveryPending {
+			return false
+		}
+	}
+	return true
+}
+
+// Updates the receipt being waited on for a message, if there is one, with the final state of its delivery to recipient.
+func (inst *Instance) resolveDelivery(mesId uint64, recipient uuid.UUID, state DeliveryState, reason string) {
+	inst.l.RLock()
+	pending := inst.receipts[mesId]
+	inst.l.RUnlock()
+	if pending == nil {
+		return
+	}
+
+	pending.l.Lock()
+	defer pending.l.Unlock()
+	if s, ok := pending.statuses[recipient]; !ok || s.State != DeliveryPending {
+		return
+	}
+	pending.statuses[recipient] = RecipientStatus{State: state, Reason: reason}
+	pending.remaining--
+	if pending.remaining == 0 {
+		close(pending.done)
+	}
+}
+
+// Updates the receipt being waited on for a message, if there is one, after its delivery was moved to another member of
+// a queue group.
+func (inst *Instance) reassignDelivery(mesId uint64, from, to uuid.UUID) {
+	inst.l.RLock()
+	pending := inst.receipts[mesId]
+	inst.l.RUnlock()
+	if pending == nil {
+		return
+	}
+
+	pending.l.Lock()
+	defer pending.l.Unlock()
+	s, ok := pending.statuses[from]
+	if !ok || s.State != DeliveryPending {
+		return
+	}
+	delete(pending.statuses, from)
+	pending.statuses[to] = s
+}
@@ -0,0 +1,150 @@
+package tolliver
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/connections"
+)
+
+const (
+	// Set on requests, and echoed back on the reply so the requester can match them up
+	correlationHeader = reservedHeaderPrefix + "correlation-id"
+	// Set on replies to the correlation id of the request being answered
+	replyToHeader = reservedHeaderPrefix + "reply-to"
+	// Set on replies when the request handler failed, holding the error message
+	errorHeader = reservedHeaderPrefix + "error"
+)
+
+// Returned by Instance.Request when the remote's request handler returned an error.
+type RemoteError struct {
+	// UUID of the instance which handled the request
+	Remote  uuid.UUID
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Remote.String() + " >>> " + e.Message
+}
+
+// Handles a request received on a channel key pair. The returned bytes are sent back to the requester as the body of
+// the reply, or if an error is returned its message is passed back instead and returned from Instance.Request as a
+// *RemoteError.
+type RequestHandler func(ctx context.Context, m *Message) ([]byte, error)
+
+// Sends a request to the instances subscribed on the channel key pair and waits for the first reply, which is returned
+// as a Message. The request is sent reliably, and if ctx has a deadline the request expires with it so that it isn't
+// delivered after the caller has given up.
+//
+// ErrNoRecipients is returned if no remote is subscribed, a *RemoteError if the remote's handler failed, and the
+// context's error if no reply arrives in time.
+func (inst *Instance) Request(ctx context.Context, channel, key string, body []byte, opts ...SendOption) (*Message, error) {
+	if err := checkSendChannel(channel); err != nil {
+		return nil, err
+	}
+	o, err := buildSendOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	correlationId := uuid.NewString()
+	if o.headers == nil {
+		o.headers = make(map[string]string, 1)
+	}
+	o.headers[correlationHeader] = correlationId
+	if deadline, ok := ctx.Deadline(); ok && (o.expiresAt.IsZero() || deadline.Before(o.expiresAt)) {
+		o.expiresAt = deadline
+	}
+
+	replies := make(chan *Message, 1)
+	inst.l.Lock()
+	if inst.requests == nil {
+		inst.requests = make(map[string]chan *Message)
+	}
+	inst.requests[correlationId] = replies
+	inst.l.Unlock()
+	defer func() {
+		inst.l.Lock()
+		delete(inst.requests, correlationId)
+		inst.l.Unlock()
+	}()
+
+	recipients := 0
+	o.onSaved = func(id uint64, ids []uuid.UUID) {
+		recipients = len(ids)
+	}
+	if err := inst.send(ctx, body, channel, key, true, o); err != nil {
+		return nil, err
+	}
+	if recipients == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	select {
+	case m := <-replies:
+		if msg, failed := m.Headers[errorHeader]; failed {
+			return m, &RemoteError{Remote: m.Sender, Message: msg}
+		}
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Registers a handler for requests sent with Instance.Request on the given channel key pair, with the same wildcard
+// rules as Register. Messages on the pair which aren't requests are ignored by the handler. The request is acked once
+// the reply has been sent back to the requester, so if the reply can't be sent the request will be redelivered and
+// the handler run again.
+func (inst *Instance) HandleRequest(channel, key string, h RequestHandler) error {
+	return inst.RegisterHandler(channel, key, func(ctx context.Context, m *Message) error {
+		correlationId, ok := m.Headers[correlationHeader]
+		if !ok {
+			return nil
+		}
+
+		headers := map[string]string{replyToHeader: correlationId}
+		body, err := h(ctx, m)
+		if err != nil {
+			headers[errorHeader] = err.Error()
+			body = nil
+		}
+
+		return inst.reply(m, body, headers)
+	})
+}
+
+// Sends a reply straight back to the sender of m, bypassing subscriptions. Replies are unreliable since the requester
+// only waits for them until its context is done.
+func (inst *Instance) reply(m *Message, body []byte, headers map[string]string) error {
+	inst.l.RLock()
+	conn := inst.conns[m.Sender]
+	inst.l.RUnlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return connections.SendBytes(buildMes(body, 0, m.Channel, m.Key, headers), conn)
+}
+
+// Passes a reply to the Request call waiting for it, returning false if m isn't a reply. Replies to requests which
+// have already finished are dropped.
+func (inst *Instance) routeReply(m *Message) bool {
+	correlationId, ok := m.Headers[replyToHeader]
+	if !ok {
+		return false
+	}
+
+	inst.l.RLock()
+	replies := inst.requests[correlationId]
+	inst.l.RUnlock()
+	if replies == nil {
+		return true
+	}
+
+	select {
+	case replies <- m:
+	default:
+		// Another recipient already replied
+	}
+	return true
+}
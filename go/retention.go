@@ -0,0 +1,169 @@
+package tolliver
+
+import (
+	"errors"
+	"time"
+)
+
+// What happens when a reliable send would take the store over the quotas in RetentionPolicy
+type OverflowPolicy int
+
+const (
+	// The send fails with ErrStoreFull until enough messages have been delivered and deleted
+	OverflowReject OverflowPolicy = iota
+	// The oldest messages are deleted to make room, along with their dead letters and any deliveries still pending,
+	// which are never made. Waiting SendAndWait calls see the dropped recipients as DeliveryDropped.
+	OverflowDropOldest
+)
+
+var ErrStoreFull = errors.New("The store has reached its quota")
+
+// Controls how long saved messages are kept and how much space they may take up.
+type RetentionPolicy struct {
+	// How long to keep a message after it was sent. Once this has passed, the message is deleted as soon as no pending
+	// delivery or dead letter refers to it. If 0 messages are deleted as soon as nothing refers to them.
+	Period time.Duration
+
+	// Retention periods for particular channels, overriding Period. Unreliable messages sent on these channels are
+	// saved too, so that remotes which subscribe later can have every message replayed to them with
+	// Instance.SubscribeFrom.
+	Channels map[string]time.Duration
+
+	// How often to delete messages which are no longer needed, defaults to one minute
+	Interval time.Duration
+
+	// How often to give the space freed by deleted messages back to the operating system, defaults to one hour. Set a
+	// negative value to disable compaction.
+	CompactInterval time.Duration
+
+	// Most messages to keep, whether retained, pending or dead lettered. If 0 there is no limit. Protocol messages, such
+	// as subscriptions sent to remotes, don't count towards either limit and are never dropped.
+	MaxMessages int
+
+	// Most bytes of message bodies to keep. If 0 there is no limit.
+	MaxBytes int64
+
+	// What to do once MaxMessages or MaxBytes would be exceeded, defaults to OverflowReject
+	Overflow OverflowPolicy
+}
+
+func (r *RetentionPolicy) populateDefaults() {
+	if r.Interval == 0 {
+		r.Interval = time.Minute
+	}
+	if r.CompactInterval == 0 {
+		r.CompactInterval = time.Hour
+	}
+}
+
+func (r RetentionPolicy) exceeds(u StoreUsage) bool {
+	return (r.MaxMessages > 0 && u.Messages > r.MaxMessages) || (r.MaxBytes > 0 && u.Bytes > r.MaxBytes)
+}
+
+// Deletes messages which are no longer needed every RetentionPolicy.Interval and compacts the store every
+// RetentionPolicy.CompactInterval.
+func (inst *Instance) collect() {
+	defer inst.wg.Done()
+	ticker := time.NewTicker(inst.retention.Interval)
+	defer ticker.Stop()
+	var compact <-chan time.Time
+	if inst.retention.CompactInterval > 0 {
+		t := time.NewTicker(inst.retention.CompactInterval)
+		defer t.Stop()
+		compact = t.C
+	}
+
+	for {
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+			inst.collectGarbage(time.Now())
+		case <-compact:
+			if err := inst.store.Compact(inst.ctx); err != nil {
+				inst.logger.Error("Failed to compact store", "err", err)
+			}
+		}
+	}
+}
+
+// Reports whether messages sent on the channel are kept for replay.
+func (r RetentionPolicy) retains(channel string) bool {
+	return r.Channels[channel] > 0
+}
+
+func (inst *Instance) collectGarbage(now time.Time) {
+	channels := make(map[string]time.Time, len(inst.retention.Channels))
+	for channel, period := range inst.retention.Channels {
+		channels[channel] = now.Add(-period)
+	}
+
+	deleted, err := inst.store.DeleteUnreferenced(inst.ctx, now.Add(-inst.retention.Period), channels)
+	if err != nil {
+		inst.logger.Error("Failed to delete old messages", "err", err)
+	} else if deleted > 0 {
+		inst.logger.Debug("Deleted old messages", "count", deleted)
+	}
+
+	if inst.retention.Overflow == OverflowDropOldest {
+		inst.dropOldest()
+	}
+	inst.refreshUsage()
+}
+
+// Reloads the usage quotas are checked against from the store, which corrects for sends that failed after reserving
+// space and for messages saved with SendTx whose transaction was rolled back.
+func (inst *Instance) refreshUsage() {
+	// Waits for sends which have reserved space to save their messages, so the measurement includes them
+	inst.quotaL.Lock()
+	defer inst.quotaL.Unlock()
+	u, err := inst.store.Usage(inst.ctx)
+	if err != nil {
+		inst.logger.Error("Failed to measure store usage", "err", err)
+		return
+	}
+
+	inst.l.Lock()
+	inst.usage = u
+	inst.l.Unlock()
+}
+
+// Accounts for a message of the given size about to be saved, failing with ErrStoreFull if that would take the store
+// over quota and the overflow policy is OverflowReject. Protocol messages don't count towards the quota, so subscribing
+// keeps working while the store is full. Send holds quotaL read locked from here until the message is saved.
+func (inst *Instance) reserve(channel string, size int) error {
+	if channel == ReservedTolliverChannel {
+		return nil
+	}
+
+	inst.l.Lock()
+	defer inst.l.Unlock()
+
+	u := StoreUsage{Messages: inst.usage.Messages + 1, Bytes: inst.usage.Bytes + int64(size)}
+	if inst.retention.Overflow == OverflowReject && inst.retention.exceeds(u) {
+		return ErrStoreFull
+	}
+	inst.usage = u
+	return nil
+}
+
+// Deletes the oldest messages if the store is over quota, resolving any deliveries which were still pending.
+func (inst *Instance) dropOldest() {
+	inst.l.RLock()
+	over := inst.retention.exceeds(inst.usage)
+	inst.l.RUnlock()
+	if !over {
+		return
+	}
+
+	dropped, err := inst.store.DropOldest(inst.ctx, StoreUsage{Messages: inst.retention.MaxMessages, Bytes: inst.retention.MaxBytes})
+	if err != nil {
+		inst.logger.Error("Failed to drop messages over quota", "err", err)
+		return
+	}
+	for _, d := range dropped {
+		inst.logger.Warn("Dropped undelivered message to stay within quota", "message", d.MessageID, "remote", d.Recipient.String(), "channel", d.Channel, "key", d.Key)
+		inst.resolveDelivery(d.MessageID, d.Recipient, DeliveryDropped, "quota exceeded")
+	}
+	inst.refreshUsage()
+}
@@ -0,0 +1,333 @@
+package tolliver
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/common"
+	"github.com/tug-dev/tolliver/go/internal/db"
+	_ "modernc.org/sqlite"
+)
+
+// Returned when opening a database which has already been migrated by a newer version of tolliver.
+var ErrSchemaTooNew = db.ErrSchemaTooNew
+
+// The default Store, which keeps everything in a SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+	id uuid.UUID
+	// Whether the store opened the database itself, and so should close it
+	owned bool
+	// The subscription table, kept in memory so that routing a message doesn't scan it
+	subs *subscriberIndex
+}
+
+// Opens the SQLite database at path, creating it if it doesn't exist.
+func OpenSQLiteStore(ctx context.Context, path string) (*SQLiteStore, error) {
+	database, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer, so share one connection rather than fail with SQLITE_BUSY
+	database.SetMaxOpenConns(1)
+	// Lets Compact free space without rebuilding the whole file. Existing databases only switch over once they have been
+	// rebuilt by a full VACUUM.
+	if _, err := database.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	s, err := NewSQLiteStore(ctx, database)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	s.owned = true
+	return s, nil
+}
+
+// Uses an already open SQLite database, creating the tables tolliver needs or upgrading them from an older version of
+// tolliver if necessary. The upgrade happens in a single transaction, and ErrSchemaTooNew is returned if the database
+// was upgraded by a newer version. The database isn't closed by SQLiteStore.Close. Since SQLite only allows a single
+// writer, it should either be limited to one open connection or have a busy timeout set.
+func NewSQLiteStore(ctx context.Context, database *sql.DB) (*SQLiteStore, error) {
+	id, err := db.Init(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := db.GetSubscriptions(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+	index := newSubscriberIndex()
+	for remote, s := range subs {
+		index.replace(remote, fromSubscriptionInfos(s))
+	}
+
+	return &SQLiteStore{db: database, id: id, subs: index}, nil
+}
+
+func (s *SQLiteStore) InstanceID(ctx context.Context) (uuid.UUID, error) {
+	return s.id, nil
+}
+
+func (s *SQLiteStore) SaveMessage(ctx context.Context, m StoredMessage, recipients []Recipient) (uint64, []uint64, error) {
+	return db.SaveMessage(ctx, toDBMessage(m), toDBRecipients(recipients), s.db)
+}
+
+func (s *SQLiteStore) SaveMessageTx(ctx context.Context, tx *sql.Tx, m StoredMessage, recipients []Recipient) (uint64, error) {
+	id, _, err := db.SaveMessageTx(ctx, toDBMessage(m), toDBRecipients(recipients), tx)
+	return id, err
+}
+
+func (s *SQLiteStore) Ack(ctx context.Context, mesId uint64, recipient uuid.UUID) error {
+	return db.Ack(ctx, mesId, recipient, s.db)
+}
+
+func (s *SQLiteStore) DueDeliveries(ctx context.Context, now time.Time, recipients []uuid.UUID) ([]StoredDelivery, error) {
+	return fromDBDeliveries(db.GetWork(ctx, s.db, now, recipients))
+}
+
+func (s *SQLiteStore) PendingDeliveries(ctx context.Context, recipient uuid.UUID) ([]StoredDelivery, error) {
+	return fromDBDeliveries(db.GetUndeliveredByUUID(ctx, s.db, recipient))
+}
+
+func (s *SQLiteStore) DueGroupDeliveries(ctx context.Context, now time.Time) ([]StoredDelivery, error) {
+	return fromDBDeliveries(db.GetGroupWork(ctx, s.db, now))
+}
+
+func (s *SQLiteStore) Reassign(ctx context.Context, mesId uint64, from, to uuid.UUID) (bool, error) {
+	return db.Reassign(ctx, s.db, mesId, from, to)
+}
+
+func (s *SQLiteStore) Replay(ctx context.Context, recipient uuid.UUID, channel, key string, since time.Time) (int, error) {
+	return db.Replay(ctx, s.db, recipient, channel, key, ReservedTolliverChannel, since)
+}
+
+func (s *SQLiteStore) DeliverRetained(ctx context.Context, recipient uuid.UUID, channel, key string) (int, error) {
+	return db.DeliverRetained(ctx, s.db, recipient, channel, key)
+}
+
+func (s *SQLiteStore) RecordAttempt(ctx context.Context, mesId uint64, recipient uuid.UUID, at, next time.Time) error {
+	return db.RecordAttempt(ctx, s.db, mesId, recipient, at, next)
+}
+
+func (s *SQLiteStore) FirstPendingSeq(ctx context.Context, channel, key string, recipient uuid.UUID) (uint64, error) {
+	return db.FirstPendingSeq(ctx, s.db, channel, key, recipient)
+}
+
+func (s *SQLiteStore) ExpireDeliveries(ctx context.Context, now time.Time) ([]DeadLetter, error) {
+	return fromDBDeadLetters(db.ExpireDeliveries(ctx, s.db, now))
+}
+
+func (s *SQLiteStore) ExhaustDeliveries(ctx context.Context, maxAttempts int, now time.Time) ([]DeadLetter, error) {
+	return fromDBDeadLetters(db.ExhaustDeliveries(ctx, s.db, maxAttempts, now))
+}
+
+func (s *SQLiteStore) Reject(ctx context.Context, mesId uint64, recipient uuid.UUID, detail string, now time.Time) ([]DeadLetter, error) {
+	return fromDBDeadLetters(db.Reject(ctx, s.db, mesId, recipient, detail, now))
+}
+
+func (s *SQLiteStore) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	return fromDBDeadLetters(db.GetDeadLetters(ctx, s.db, db.DeadLetterFilter{
+		Channel:   filter.Channel,
+		Key:       filter.Key,
+		Recipient: filter.Recipient,
+		Reason:    string(filter.Reason),
+		Limit:     filter.Limit,
+	}))
+}
+
+func (s *SQLiteStore) Requeue(ctx context.Context, id uint64, now time.Time) (bool, error) {
+	return db.Requeue(ctx, s.db, id, now)
+}
+
+func (s *SQLiteStore) PurgeDeadLetter(ctx context.Context, id uint64) (bool, error) {
+	return db.PurgeDeadLetter(ctx, s.db, id)
+}
+
+func (s *SQLiteStore) Subscribers(ctx context.Context, channel, key string) ([]uuid.UUID, error) {
+	return s.subs.match(channel, key), nil
+}
+
+func (s *SQLiteStore) Groups(ctx context.Context, channel, key string) (map[string][]uuid.UUID, error) {
+	return s.subs.groups(channel, key), nil
+}
+
+func (s *SQLiteStore) AddSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error {
+	if err := db.Subscribe(ctx, toSubscriptionInfo(sub), remote, s.db); err != nil {
+		return err
+	}
+	s.subs.add(remote, sub)
+	return nil
+}
+
+func (s *SQLiteStore) RemoveSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error {
+	if err := db.Unsubscribe(ctx, toSubscriptionInfo(sub), remote, s.db); err != nil {
+		return err
+	}
+	s.subs.remove(remote, sub)
+	return nil
+}
+
+func (s *SQLiteStore) ReplaceSubscriptions(ctx context.Context, remote uuid.UUID, subs []Subscription) error {
+	if err := db.ReplaceSubscriptions(ctx, remote, toSubscriptionInfos(subs), s.db); err != nil {
+		return err
+	}
+	s.subs.replace(remote, subs)
+	return nil
+}
+
+func (s *SQLiteStore) LocalSubscriptions(ctx context.Context) ([]Subscription, error) {
+	subs, err := db.GetLocalSubscriptions(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	return fromSubscriptionInfos(subs), nil
+}
+
+func (s *SQLiteStore) AddLocalSubscription(ctx context.Context, sub Subscription) (bool, error) {
+	return db.AddLocalSubscription(ctx, toSubscriptionInfo(sub), s.db)
+}
+
+func (s *SQLiteStore) RemoveLocalSubscription(ctx context.Context, sub Subscription) error {
+	return db.RemoveLocalSubscription(ctx, toSubscriptionInfo(sub), s.db)
+}
+
+func (s *SQLiteStore) Processed(ctx context.Context, sender uuid.UUID, mesId uint64) (bool, error) {
+	return db.Processed(ctx, s.db, sender, mesId)
+}
+
+func (s *SQLiteStore) MarkProcessed(ctx context.Context, sender uuid.UUID, mesId uint64, at time.Time) error {
+	return db.MarkProcessed(ctx, s.db, sender, mesId, at)
+}
+
+func (s *SQLiteStore) PruneInbox(ctx context.Context, before time.Time) error {
+	return db.PruneInbox(ctx, s.db, before)
+}
+
+func (s *SQLiteStore) PinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) error {
+	return db.PinCertificate(ctx, s.db, remote, fingerprint[:])
+}
+
+func (s *SQLiteStore) UnpinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error) {
+	return db.UnpinCertificate(ctx, s.db, remote, fingerprint[:])
+}
+
+func (s *SQLiteStore) CertificatePinned(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error) {
+	return db.CertificatePinned(ctx, s.db, remote, fingerprint[:])
+}
+
+func (s *SQLiteStore) DeleteUnreferenced(ctx context.Context, savedBefore time.Time, channels map[string]time.Time) (int, error) {
+	return db.DeleteUnreferenced(ctx, s.db, savedBefore, channels)
+}
+
+func (s *SQLiteStore) Usage(ctx context.Context) (StoreUsage, error) {
+	messages, bytes, err := db.Usage(ctx, s.db, ReservedTolliverChannel)
+	return StoreUsage{Messages: messages, Bytes: bytes}, err
+}
+
+func (s *SQLiteStore) DropOldest(ctx context.Context, limits StoreUsage) ([]StoredDelivery, error) {
+	return fromDBDeliveries(db.DropOldest(ctx, s.db, limits.Messages, limits.Bytes, ReservedTolliverChannel))
+}
+
+// Databases opened by OpenSQLiteStore are vacuumed incrementally, while others are rebuilt with VACUUM whenever they
+// have free pages. That needs as much spare disk space as the database takes up and blocks writers until it is done.
+func (s *SQLiteStore) Compact(ctx context.Context) error {
+	return db.Compact(ctx, s.db)
+}
+
+// Closes the database if it was opened by OpenSQLiteStore.
+func (s *SQLiteStore) Close() error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func toDBMessage(m StoredMessage) db.Message {
+	return db.Message{Channel: m.Channel, Key: m.Key, Data: m.Body, Headers: m.Headers, ExpiresAt: m.ExpiresAt, Ordered: m.Ordered, SavedAt: m.SavedAt, Retain: m.Retain}
+}
+
+func fromDBDelivery(d db.Delivery) StoredDelivery {
+	return StoredDelivery{
+		MessageID: d.MesId,
+		Recipient: d.Receiver,
+		Channel:   d.Channel,
+		Key:       d.Key,
+		Body:      d.Payload,
+		Headers:   d.Headers,
+		Attempts:  d.Attempts,
+		ExpiresAt: d.ExpiresAt,
+		Seq:       d.Seq,
+		Group:     d.Group,
+	}
+}
+
+func fromDBDeliveries(deliveries []db.Delivery, err error) ([]StoredDelivery, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]StoredDelivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		out = append(out, fromDBDelivery(d))
+	}
+	return out, nil
+}
+
+func fromDBDeadLetters(letters []db.DeadLetter, err error) ([]DeadLetter, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DeadLetter, 0, len(letters))
+	for _, l := range letters {
+		out = append(out, DeadLetter{
+			ID:        l.Id,
+			MessageID: l.MesId,
+			Recipient: l.Receiver,
+			Channel:   l.Channel,
+			Key:       l.Key,
+			Body:      l.Payload,
+			Headers:   l.Headers,
+			ExpiresAt: l.ExpiresAt,
+			Reason:    DeadLetterReason(l.Reason),
+			Detail:    l.Detail,
+			Attempts:  l.Attempts,
+			DeadAt:    l.DeadAt,
+		})
+	}
+	return out, nil
+}
+
+func toSubscriptionInfo(s Subscription) common.SubcriptionInfo {
+	return common.SubcriptionInfo{Channel: s.Channel, Key: s.Key, Group: s.Group}
+}
+
+func toSubscriptionInfos(subs []Subscription) []common.SubcriptionInfo {
+	out := make([]common.SubcriptionInfo, 0, len(subs))
+	for _, s := range subs {
+		out = append(out, toSubscriptionInfo(s))
+	}
+	return out
+}
+
+func fromSubscriptionInfos(subs []common.SubcriptionInfo) []Subscription {
+	out := make([]Subscription, 0, len(subs))
+	for _, s := range subs {
+		out = append(out, Subscription{Channel: s.Channel, Key: s.Key, Group: s.Group})
+	}
+	return out
+}
+
+func toDBRecipients(recipients []Recipient) []db.Recipient {
+	out := make([]db.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		out = append(out, db.Recipient{ID: r.Remote, Group: r.Group})
+	}
+	return out
+}
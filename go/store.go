@@ -0,0 +1,188 @@
+package tolliver
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/match"
+)
+
+// Persists everything an instance needs to survive a restart: its identity, the reliable messages it is delivering,
+// its dead letter queue, what it and its remotes are subscribed to, and the messages it has already processed.
+//
+// The default is a SQLiteStore, and a MemoryStore can be used where nothing needs to outlive the process. Other
+// implementations should pass the suite in the storetest package. Methods are called from several goroutines at once.
+type Store interface {
+	// Returns the UUID of the instance using the store, generating and saving one on first use.
+	InstanceID(ctx context.Context) (uuid.UUID, error)
+
+	// Saves a message along with a pending delivery to each recipient, which is due straight away. Returns the id of
+	// the message and, if it is ordered, the sequence number given to each recipient in the same order as recipients.
+	// Each recipient has its own sequence on each channel and key, starting from 1. Messages with Retain set replace
+	// the retained value on their channel and key, or clear it if their body is empty.
+	SaveMessage(ctx context.Context, m StoredMessage, recipients []Recipient) (id uint64, seqs []uint64, err error)
+	// Removes a pending delivery once the recipient has acked it. Acking a delivery which doesn't exist isn't an error.
+	Ack(ctx context.Context, mesId uint64, recipient uuid.UUID) error
+	// Returns the pending deliveries to any of the recipients whose next attempt is due at now, oldest message first.
+	DueDeliveries(ctx context.Context, now time.Time, recipients []uuid.UUID) ([]StoredDelivery, error)
+	// Returns every pending delivery to the recipient, whether or not it is due, oldest message first.
+	PendingDeliveries(ctx context.Context, recipient uuid.UUID) ([]StoredDelivery, error)
+	// Returns the pending deliveries to members of queue groups whose next attempt is due at now, whichever member they
+	// are addressed to, oldest message first.
+	DueGroupDeliveries(ctx context.Context, now time.Time) ([]StoredDelivery, error)
+	// Moves a pending delivery to another recipient, due straight away and keeping its attempts and group. An ordered
+	// delivery is given the next sequence number of the new recipient. Returns false if the delivery doesn't exist or
+	// the new recipient already has a pending delivery of the message.
+	Reassign(ctx context.Context, mesId uint64, from, to uuid.UUID) (bool, error)
+	// Adds a pending delivery to the recipient, due straight away, for every message on the channel key pair which was
+	// saved at or after since and isn't already pending for it. The channel is matched like a subscription, but messages
+	// on the reserved tolliver channel are never replayed. Replayed deliveries have no sequence number, even if the
+	// message was ordered. Returns how many deliveries were added.
+	Replay(ctx context.Context, recipient uuid.UUID, channel, key string, since time.Time) (int, error)
+	// Adds a pending delivery to the recipient, due straight away, for every retained value the subscription matches
+	// which isn't already pending for it, matching channels with MatchChannel. Returns how many deliveries were added.
+	DeliverRetained(ctx context.Context, recipient uuid.UUID, channel, key string) (int, error)
+	// Records an attempt to send a delivery at the given time, and when it should next be sent if it isn't acked.
+	RecordAttempt(ctx context.Context, mesId uint64, recipient uuid.UUID, at, next time.Time) error
+	// Returns the lowest sequence number of the ordered messages on the channel and key still pending delivery to the
+	// recipient, or 0 if there are none.
+	FirstPendingSeq(ctx context.Context, channel, key string, recipient uuid.UUID) (uint64, error)
+
+	// Moves the pending deliveries of messages which expired at or before now to the dead letter queue.
+	ExpireDeliveries(ctx context.Context, now time.Time) ([]DeadLetter, error)
+	// Moves pending deliveries which have been attempted maxAttempts times, and whose next attempt is due at now, to the
+	// dead letter queue.
+	ExhaustDeliveries(ctx context.Context, maxAttempts int, now time.Time) ([]DeadLetter, error)
+	// Moves a pending delivery which the recipient nacked to the dead letter queue.
+	Reject(ctx context.Context, mesId uint64, recipient uuid.UUID, detail string, now time.Time) ([]DeadLetter, error)
+	// Lists the dead letters matching the filter, oldest first.
+	DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error)
+	// Turns a dead letter back into a pending delivery which is due straight away, returning false if it doesn't exist.
+	// An expired delivery no longer expires, and an ordered message is given the recipient's next sequence number. The
+	// message's deliveries to other recipients are left as they are.
+	Requeue(ctx context.Context, id uint64, now time.Time) (bool, error)
+	// Deletes a dead letter, returning false if it doesn't exist.
+	PurgeDeadLetter(ctx context.Context, id uint64) (bool, error)
+
+	// Returns the remotes with a subscription outside any queue group matching the channel key pair, each once. Channels
+	// are matched with MatchChannel and keys exactly, with blank keys matching anything.
+	Subscribers(ctx context.Context, channel, key string) ([]uuid.UUID, error)
+	// Returns the members of each queue group with a subscription matching the channel key pair, by group. Members are
+	// listed once each, ordered by UUID.
+	Groups(ctx context.Context, channel, key string) (map[string][]uuid.UUID, error)
+	// Records a subscription of a remote, doing nothing if it already exists.
+	AddSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error
+	RemoveSubscription(ctx context.Context, remote uuid.UUID, sub Subscription) error
+	// Replaces every subscription recorded for the remote.
+	ReplaceSubscriptions(ctx context.Context, remote uuid.UUID, subs []Subscription) error
+
+	// Returns the subscriptions of the instance itself, in the order they were added.
+	LocalSubscriptions(ctx context.Context) ([]Subscription, error)
+	// Saves a subscription of the instance itself, returning false if it already exists.
+	AddLocalSubscription(ctx context.Context, sub Subscription) (bool, error)
+	RemoveLocalSubscription(ctx context.Context, sub Subscription) error
+
+	// Reports whether the message from sender was recorded as processed.
+	Processed(ctx context.Context, sender uuid.UUID, mesId uint64) (bool, error)
+	MarkProcessed(ctx context.Context, sender uuid.UUID, mesId uint64, at time.Time) error
+	// Forgets messages processed before the given time.
+	PruneInbox(ctx context.Context, before time.Time) error
+
+	// Records that the remote may present the certificate with the given fingerprint, doing nothing if it already may.
+	PinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) error
+	// Removes a pinned certificate, returning false if it wasn't pinned for the remote.
+	UnpinCertificate(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error)
+	// Reports whether the certificate with the given fingerprint is pinned for the remote.
+	CertificatePinned(ctx context.Context, remote uuid.UUID, fingerprint Fingerprint) (bool, error)
+
+	// Deletes messages saved before the given time which have no pending deliveries or dead letters left and aren't
+	// retained, returning how many were deleted. Messages on the channels in the map use the time given for their
+	// channel instead.
+	DeleteUnreferenced(ctx context.Context, savedBefore time.Time, channels map[string]time.Time) (int, error)
+	// Returns how many messages are saved, whether or not they are still referenced, and the total size of their bodies.
+	// Messages on the reserved tolliver channel aren't counted.
+	Usage(ctx context.Context) (StoreUsage, error)
+	// Deletes the oldest messages, along with their pending deliveries, dead letters and retained values, until the
+	// store is within the limits, where zero fields mean no limit. Messages on the reserved tolliver channel are never
+	// deleted and don't count towards the limits. Returns the pending deliveries which were deleted, oldest message
+	// first.
+	DropOldest(ctx context.Context, limits StoreUsage) ([]StoredDelivery, error)
+	// Gives the space freed by deleted messages back to the operating system, if the store holds on to it.
+	Compact(ctx context.Context) error
+
+	// Releases whatever the store holds. Called by Instance.Close for stores the instance created itself.
+	Close() error
+}
+
+// Implemented by stores which can save messages inside an application's SQL transaction, as needed by Instance.SendTx.
+type TxStore interface {
+	Store
+	// Saves a message like SaveMessage as part of tx, returning its id.
+	SaveMessageTx(ctx context.Context, tx *sql.Tx, m StoredMessage, recipients []Recipient) (uint64, error)
+}
+
+// A channel key pair subscribed to. The channel may be a pattern, see MatchChannel, and a blank key matches any key.
+type Subscription struct {
+	Channel string
+	Key     string
+	// Queue group the subscriber is a member of. Each message is delivered to just one member of a group, rather than
+	// to every subscriber. Blank if the subscriber isn't in a group.
+	Group string
+}
+
+// A remote a message is saved for.
+type Recipient struct {
+	Remote uuid.UUID
+	// Queue group the remote was chosen from, blank if it is subscribed by itself
+	Group string
+}
+
+// Reports whether a channel is matched by the channel of a subscription. Channels are split into tokens by '.' and
+// '/', and in a pattern a token of "*" matches any single token while a final token of ">" matches one or more, so
+// "vm.*.shutdown" matches "vm.eu.shutdown" and "vm.>" matches "vm.eu.shutdown" but not "vm". A blank pattern matches
+// every channel, and any other pattern has to match exactly.
+func MatchChannel(pattern, channel string) bool {
+	return match.Match(pattern, channel)
+}
+
+// A reliable message as saved by a Store
+type StoredMessage struct {
+	Channel string
+	Key     string
+	Body    []byte
+	Headers map[string]string
+	// Zero if the message never expires
+	ExpiresAt time.Time
+	// Whether each recipient is given the next sequence number in its stream on the message's channel and key
+	Ordered bool
+	// When the message was saved, which retention is measured from
+	SavedAt time.Time
+	// Whether the message becomes the retained value on its channel and key
+	Retain bool
+}
+
+// How much a Store holds. Only message bodies are counted towards Bytes.
+type StoreUsage struct {
+	Messages int
+	Bytes    int64
+}
+
+// A reliable message still waiting to be acked by one of its recipients
+type StoredDelivery struct {
+	MessageID uint64
+	Recipient uuid.UUID
+	Channel   string
+	Key       string
+	Body      []byte
+	Headers   map[string]string
+	// Number of times the message has already been sent to the recipient
+	Attempts int
+	// Zero if the message never expires
+	ExpiresAt time.Time
+	// Position of the message in the recipient's stream on its channel and key, zero unless it is ordered
+	Seq uint64
+	// Queue group the recipient was chosen from, blank if it is subscribed by itself
+	Group string
+}
@@ -0,0 +1,882 @@
+// Package storetest checks that a tolliver.Store behaves the way an instance expects. Implementations outside this
+// module should call Run from one of their own tests.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	tolliver "github.com/tug-dev/tolliver/go"
+)
+
+// Runs the conformance suite against stores returned by newStore, which is called once per subtest and must return an
+// empty store. Stores are closed by the suite.
+func Run(t *testing.T, newStore func(t *testing.T) tolliver.Store) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s tolliver.Store)
+	}{
+		{"InstanceID", testInstanceID},
+		{"SaveAndAck", testSaveAndAck},
+		{"DueDeliveries", testDueDeliveries},
+		{"PendingDeliveries", testPendingDeliveries},
+		{"Ordered", testOrdered},
+		{"Expire", testExpire},
+		{"Exhaust", testExhaust},
+		{"RejectAndRequeue", testRejectAndRequeue},
+		{"Purge", testPurge},
+		{"DeadLetterFilter", testDeadLetterFilter},
+		{"Subscriptions", testSubscriptions},
+		{"Patterns", testPatterns},
+		{"Groups", testGroups},
+		{"LocalSubscriptions", testLocalSubscriptions},
+		{"Inbox", testInbox},
+		{"CertificatePins", testCertificatePins},
+		{"DeleteUnreferenced", testDeleteUnreferenced},
+		{"DropOldest", testDropOldest},
+		{"Replay", testReplay},
+		{"Retained", testRetained},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			})
+			tt.run(t, s)
+		})
+	}
+}
+
+// Times are truncated to milliseconds, the finest precision a store has to keep.
+func now() time.Time {
+	return time.UnixMilli(time.Now().UnixMilli())
+}
+
+func newID(t *testing.T) uuid.UUID {
+	id, err := uuid.NewV7()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func save(t *testing.T, s tolliver.Store, m tolliver.StoredMessage, recipients ...uuid.UUID) (uint64, []uint64) {
+	t.Helper()
+	r := make([]tolliver.Recipient, 0, len(recipients))
+	for _, id := range recipients {
+		r = append(r, tolliver.Recipient{Remote: id})
+	}
+	id, seqs, err := s.SaveMessage(context.Background(), m, r)
+	check(t, err)
+	return id, seqs
+}
+
+func pending(t *testing.T, s tolliver.Store, recipient uuid.UUID) []tolliver.StoredDelivery {
+	t.Helper()
+	deliveries, err := s.PendingDeliveries(context.Background(), recipient)
+	check(t, err)
+	return deliveries
+}
+
+func messageIDs(deliveries []tolliver.StoredDelivery) []uint64 {
+	var ids []uint64
+	for _, d := range deliveries {
+		ids = append(ids, d.MessageID)
+	}
+	return ids
+}
+
+func sameSet(a, b []uuid.UUID) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	cmp := func(x, y uuid.UUID) int { return bytes.Compare(x[:], y[:]) }
+	slices.SortFunc(a, cmp)
+	slices.SortFunc(b, cmp)
+	return slices.Equal(a, b)
+}
+
+func testInstanceID(t *testing.T, s tolliver.Store) {
+	first, err := s.InstanceID(context.Background())
+	check(t, err)
+	if first == uuid.Nil {
+		t.Fatal("InstanceID returned the nil UUID")
+	}
+
+	second, err := s.InstanceID(context.Background())
+	check(t, err)
+	if first != second {
+		t.Fatalf("InstanceID changed from %v to %v", first, second)
+	}
+}
+
+func testSaveAndAck(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	expiresAt := now().Add(time.Hour)
+	m := tolliver.StoredMessage{Channel: "c", Key: "k", Body: []byte("body"), Headers: map[string]string{"h": "v"}, ExpiresAt: expiresAt}
+
+	first, seqs := save(t, s, m, a, b)
+	if seqs != nil {
+		t.Fatalf("Unordered message was given sequence numbers %v", seqs)
+	}
+	second, _ := save(t, s, m, a)
+	if second <= first {
+		t.Fatalf("Message ids went from %d to %d", first, second)
+	}
+
+	got := pending(t, s, a)
+	if !slices.Equal(messageIDs(got), []uint64{first, second}) {
+		t.Fatalf("Expected messages %d and %d pending, got %v", first, second, messageIDs(got))
+	}
+	d := got[0]
+	if d.Recipient != a || d.Channel != "c" || d.Key != "k" || string(d.Body) != "body" || d.Headers["h"] != "v" ||
+		d.Attempts != 0 || !d.ExpiresAt.Equal(expiresAt) || d.Seq != 0 {
+		t.Fatalf("Delivery doesn't match the saved message: %+v", d)
+	}
+
+	check(t, s.Ack(ctx, first, a))
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{second}) {
+		t.Fatalf("Expected only message %d pending after ack, got %v", second, got)
+	}
+	if got := messageIDs(pending(t, s, b)); !slices.Equal(got, []uint64{first}) {
+		t.Fatalf("Ack to one recipient affected another, got %v", got)
+	}
+
+	check(t, s.Ack(ctx, first, a))
+	check(t, s.Ack(ctx, first+100, a))
+}
+
+func testDueDeliveries(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b, c := newID(t), newID(t), newID(t)
+	id, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("x")}, a, b, c)
+
+	start := now()
+	due, err := s.DueDeliveries(ctx, start, []uuid.UUID{a, b})
+	check(t, err)
+	if len(due) != 2 {
+		t.Fatalf("Expected deliveries to the two requested recipients, got %d", len(due))
+	}
+	for _, d := range due {
+		if d.Recipient == c {
+			t.Fatal("Got a delivery to a recipient which wasn't asked for")
+		}
+	}
+
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Minute)))
+	due, err = s.DueDeliveries(ctx, start, []uuid.UUID{a})
+	check(t, err)
+	if len(due) != 0 {
+		t.Fatal("Delivery was due before its next attempt")
+	}
+
+	due, err = s.DueDeliveries(ctx, start.Add(time.Minute), []uuid.UUID{a})
+	check(t, err)
+	if len(due) != 1 || due[0].Attempts != 1 {
+		t.Fatalf("Expected one delivery with one attempt once due, got %+v", due)
+	}
+}
+
+func testPendingDeliveries(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a := newID(t)
+	id, _ := save(t, s, tolliver.StoredMessage{Channel: "c"}, a)
+	start := now()
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Hour)))
+
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{id}) {
+		t.Fatalf("Delivery which isn't due yet wasn't pending, got %v", got)
+	}
+	if got := pending(t, s, newID(t)); len(got) != 0 {
+		t.Fatalf("Got pending deliveries for an unknown recipient: %v", messageIDs(got))
+	}
+}
+
+func testOrdered(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	ordered := tolliver.StoredMessage{Channel: "c", Key: "k", Ordered: true}
+
+	first, seqs1 := save(t, s, ordered, a, b)
+	second, seqs2 := save(t, s, ordered, a)
+	_, seqs3 := save(t, s, ordered, b)
+	_, other := save(t, s, tolliver.StoredMessage{Channel: "c", Key: "other", Ordered: true}, a)
+	if !slices.Equal(seqs1, []uint64{1, 1}) || !slices.Equal(seqs2, []uint64{2}) || !slices.Equal(seqs3, []uint64{2}) || !slices.Equal(other, []uint64{1}) {
+		t.Fatalf("Expected each recipient to be numbered by itself and 1 on another key, got %v, %v, %v and %v", seqs1, seqs2, seqs3, other)
+	}
+	if d := pending(t, s, a); d[0].Seq != 1 || d[1].Seq != 2 {
+		t.Fatalf("Deliveries don't carry their sequence numbers: %+v", d)
+	}
+
+	seq, err := s.FirstPendingSeq(ctx, "c", "k", a)
+	check(t, err)
+	if seq != 1 {
+		t.Fatalf("Expected first pending sequence number 1, got %d", seq)
+	}
+	check(t, s.Ack(ctx, first, a))
+	seq, err = s.FirstPendingSeq(ctx, "c", "k", a)
+	check(t, err)
+	if seq != 2 {
+		t.Fatalf("Expected first pending sequence number 2 after ack, got %d", seq)
+	}
+	check(t, s.Ack(ctx, second, a))
+	seq, err = s.FirstPendingSeq(ctx, "c", "k", a)
+	check(t, err)
+	if seq != 0 {
+		t.Fatalf("Expected no pending sequence number after acking everything, got %d", seq)
+	}
+	seq, err = s.FirstPendingSeq(ctx, "c", "k", b)
+	check(t, err)
+	if seq != 1 {
+		t.Fatalf("Acks to one recipient affected another, got %d", seq)
+	}
+
+	save(t, s, ordered, a)
+	moved, _ := save(t, s, ordered, a)
+	found, err := s.Reassign(ctx, moved, a, b)
+	check(t, err)
+	if d := pending(t, s, b); !found || d[len(d)-1].MessageID != moved || d[len(d)-1].Seq != 3 {
+		t.Fatalf("Expected the moved delivery to be given the next sequence number of its new recipient, got %+v", d)
+	}
+}
+
+func testExpire(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a := newID(t)
+	start := now()
+	expired, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("old"), ExpiresAt: start}, a)
+	live, _ := save(t, s, tolliver.StoredMessage{Channel: "c", ExpiresAt: start.Add(time.Hour)}, a)
+	forever, _ := save(t, s, tolliver.StoredMessage{Channel: "c"}, a)
+
+	letters, err := s.ExpireDeliveries(ctx, start)
+	check(t, err)
+	if len(letters) != 1 {
+		t.Fatalf("Expected one expired delivery, got %d", len(letters))
+	}
+	l := letters[0]
+	if l.MessageID != expired || l.Recipient != a || l.Reason != tolliver.DeadLetterExpired || string(l.Body) != "old" ||
+		!l.ExpiresAt.Equal(start) || !l.DeadAt.Equal(start) {
+		t.Fatalf("Dead letter doesn't match the expired delivery: %+v", l)
+	}
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{live, forever}) {
+		t.Fatalf("Expected messages %d and %d still pending, got %v", live, forever, got)
+	}
+}
+
+func testExhaust(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a := newID(t)
+	start := now()
+	id, _ := save(t, s, tolliver.StoredMessage{Channel: "c"}, a)
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Minute)))
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Minute)))
+
+	letters, err := s.ExhaustDeliveries(ctx, 2, start)
+	check(t, err)
+	if len(letters) != 0 {
+		t.Fatal("Delivery was exhausted before its final attempt had gone unanswered")
+	}
+	letters, err = s.ExhaustDeliveries(ctx, 3, start.Add(time.Minute))
+	check(t, err)
+	if len(letters) != 0 {
+		t.Fatal("Delivery was exhausted before using up its attempts")
+	}
+
+	letters, err = s.ExhaustDeliveries(ctx, 2, start.Add(time.Minute))
+	check(t, err)
+	if len(letters) != 1 || letters[0].Reason != tolliver.DeadLetterMaxAttempts || letters[0].Attempts != 2 {
+		t.Fatalf("Expected one exhausted delivery with two attempts, got %+v", letters)
+	}
+	if got := pending(t, s, a); len(got) != 0 {
+		t.Fatalf("Exhausted delivery is still pending: %v", messageIDs(got))
+	}
+}
+
+func testRejectAndRequeue(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	start := now()
+	id, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Key: "k", ExpiresAt: start.Add(time.Minute), Ordered: true}, a, b)
+	save(t, s, tolliver.StoredMessage{Channel: "c", Key: "k", Ordered: true}, a)
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Minute)))
+
+	letters, err := s.Reject(ctx, id, a, "bad", start)
+	check(t, err)
+	if len(letters) != 1 || letters[0].Reason != tolliver.DeadLetterRejected || letters[0].Detail != "bad" {
+		t.Fatalf("Expected one rejected dead letter with its detail, got %+v", letters)
+	}
+	letters, err = s.Reject(ctx, id, a, "bad", start)
+	check(t, err)
+	if len(letters) != 0 {
+		t.Fatal("Rejecting a delivery twice dead lettered it twice")
+	}
+
+	all, err := s.DeadLetters(ctx, tolliver.DeadLetterFilter{})
+	check(t, err)
+	if len(all) != 1 {
+		t.Fatalf("Expected one dead letter, got %d", len(all))
+	}
+
+	later := start.Add(time.Hour)
+	found, err := s.Requeue(ctx, all[0].ID, later)
+	check(t, err)
+	if !found {
+		t.Fatal("Requeue didn't find the dead letter")
+	}
+	found, err = s.Requeue(ctx, all[0].ID, later)
+	check(t, err)
+	if found {
+		t.Fatal("Requeue found a dead letter which was already requeued")
+	}
+
+	var requeued *tolliver.StoredDelivery
+	due, err := s.DueDeliveries(ctx, later, []uuid.UUID{a})
+	check(t, err)
+	for i := range due {
+		if due[i].MessageID == id {
+			requeued = &due[i]
+		}
+	}
+	if requeued == nil {
+		t.Fatal("Requeued delivery isn't due")
+	}
+	if requeued.Attempts != 0 || !requeued.ExpiresAt.IsZero() || requeued.Seq != 3 {
+		t.Fatalf("Expected the requeued delivery to start over without expiring as sequence number 3, got %+v", requeued)
+	}
+	if other := pending(t, s, b); len(other) != 1 || !other[0].ExpiresAt.Equal(start.Add(time.Minute)) || other[0].Seq != 1 {
+		t.Fatalf("Requeuing changed another recipient's delivery of the message: %+v", other)
+	}
+
+	letters, err = s.ExpireDeliveries(ctx, later)
+	check(t, err)
+	if len(letters) != 1 || letters[0].Recipient != b {
+		t.Fatalf("Expected only the other recipient's delivery to expire, got %+v", letters)
+	}
+}
+
+func testPurge(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a := newID(t)
+	id, _ := save(t, s, tolliver.StoredMessage{Channel: "c"}, a)
+	letters, err := s.Reject(ctx, id, a, "", now())
+	check(t, err)
+
+	found, err := s.PurgeDeadLetter(ctx, letters[0].ID)
+	check(t, err)
+	if !found {
+		t.Fatal("PurgeDeadLetter didn't find the dead letter")
+	}
+	found, err = s.PurgeDeadLetter(ctx, letters[0].ID)
+	check(t, err)
+	if found {
+		t.Fatal("PurgeDeadLetter found a dead letter which was already purged")
+	}
+	found, err = s.Requeue(ctx, letters[0].ID, now())
+	check(t, err)
+	if found {
+		t.Fatal("Requeue found a purged dead letter")
+	}
+}
+
+func testDeadLetterFilter(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	start := now()
+	for _, m := range []tolliver.StoredMessage{{Channel: "x", Key: "1"}, {Channel: "x", Key: "2"}, {Channel: "y", Key: "1"}} {
+		id, _ := save(t, s, m, a, b)
+		_, err := s.Reject(ctx, id, a, "", start)
+		check(t, err)
+	}
+	expired, _ := save(t, s, tolliver.StoredMessage{Channel: "x", Key: "1", ExpiresAt: start}, b)
+	_, err := s.ExpireDeliveries(ctx, start)
+	check(t, err)
+
+	tests := []struct {
+		filter tolliver.DeadLetterFilter
+		want   int
+	}{
+		{tolliver.DeadLetterFilter{}, 4},
+		{tolliver.DeadLetterFilter{Channel: "x"}, 3},
+		{tolliver.DeadLetterFilter{Channel: "x", Key: "1"}, 2},
+		{tolliver.DeadLetterFilter{Recipient: a}, 3},
+		{tolliver.DeadLetterFilter{Reason: tolliver.DeadLetterExpired}, 1},
+		{tolliver.DeadLetterFilter{Limit: 2}, 2},
+	}
+	for _, tt := range tests {
+		got, err := s.DeadLetters(ctx, tt.filter)
+		check(t, err)
+		if len(got) != tt.want {
+			t.Errorf("Filter %+v: expected %d dead letters, got %d", tt.filter, tt.want, len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].ID <= got[i-1].ID {
+				t.Errorf("Filter %+v: dead letters aren't oldest first", tt.filter)
+			}
+		}
+	}
+
+	got, err := s.DeadLetters(ctx, tolliver.DeadLetterFilter{Reason: tolliver.DeadLetterExpired})
+	check(t, err)
+	if got[0].MessageID != expired || got[0].Recipient != b {
+		t.Fatalf("Wrong dead letter returned for the expired filter: %+v", got[0])
+	}
+}
+
+func testSubscriptions(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b, c, d := newID(t), newID(t), newID(t), newID(t)
+	check(t, s.AddSubscription(ctx, a, tolliver.Subscription{Channel: "c", Key: "k"}))
+	check(t, s.AddSubscription(ctx, a, tolliver.Subscription{Channel: "c", Key: "k"}))
+	check(t, s.AddSubscription(ctx, b, tolliver.Subscription{Channel: "c", Key: ""}))
+	check(t, s.AddSubscription(ctx, c, tolliver.Subscription{Channel: "", Key: "k"}))
+	check(t, s.AddSubscription(ctx, d, tolliver.Subscription{Channel: "other", Key: "k"}))
+
+	subscribers := func(channel, key string, want ...uuid.UUID) {
+		t.Helper()
+		got, err := s.Subscribers(ctx, channel, key)
+		check(t, err)
+		if !sameSet(got, want) {
+			t.Fatalf("Subscribers of %q %q: expected %v, got %v", channel, key, want, got)
+		}
+	}
+	subscribers("c", "k", a, b, c)
+	subscribers("c", "j", b)
+	subscribers("z", "k", c)
+	subscribers("z", "j")
+
+	check(t, s.RemoveSubscription(ctx, a, tolliver.Subscription{Channel: "c", Key: "k"}))
+	subscribers("c", "k", b, c)
+
+	check(t, s.ReplaceSubscriptions(ctx, b, []tolliver.Subscription{{Channel: "z", Key: "j"}}))
+	subscribers("c", "k", c)
+	subscribers("z", "j", b)
+
+	check(t, s.ReplaceSubscriptions(ctx, b, nil))
+	subscribers("z", "j")
+}
+
+func testPatterns(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b, c, d := newID(t), newID(t), newID(t), newID(t)
+	check(t, s.AddSubscription(ctx, a, tolliver.Subscription{Channel: "vm.*.shutdown", Key: ""}))
+	check(t, s.AddSubscription(ctx, b, tolliver.Subscription{Channel: "vm.>", Key: "k"}))
+	check(t, s.AddSubscription(ctx, c, tolliver.Subscription{Channel: "vm/*", Key: ""}))
+	check(t, s.AddSubscription(ctx, d, tolliver.Subscription{Channel: "vm.eu.shutdown", Key: ""}))
+
+	subscribers := func(channel, key string, want ...uuid.UUID) {
+		t.Helper()
+		got, err := s.Subscribers(ctx, channel, key)
+		check(t, err)
+		if !sameSet(got, want) {
+			t.Fatalf("Subscribers of %q %q: expected %v, got %v", channel, key, want, got)
+		}
+	}
+	subscribers("vm.eu.shutdown", "k", a, b, d)
+	subscribers("vm.eu.shutdown", "j", a, d)
+	subscribers("vm.eu", "k", b)
+	subscribers("vm", "k")
+	subscribers("vm.eu.shutdown.now", "k", b)
+	subscribers("vm/eu", "k", c)
+	subscribers("vm/eu/shutdown", "k")
+
+	check(t, s.RemoveSubscription(ctx, b, tolliver.Subscription{Channel: "vm.>", Key: "k"}))
+	subscribers("vm.eu.shutdown", "k", a, d)
+
+	start := now()
+	eu, _ := save(t, s, tolliver.StoredMessage{Channel: "vm.eu.shutdown", Key: "k", Body: []byte("v"), SavedAt: start, Retain: true})
+	us, _ := save(t, s, tolliver.StoredMessage{Channel: "vm.us.shutdown", Key: "k", Body: []byte("v"), SavedAt: start, Retain: true})
+	save(t, s, tolliver.StoredMessage{Channel: "vm.eu.start", Key: "k", Body: []byte("v"), SavedAt: start, Retain: true})
+	save(t, s, tolliver.StoredMessage{Channel: "vm/eu/shutdown", Key: "k", Body: []byte("v"), SavedAt: start, Retain: true})
+
+	added, err := s.Replay(ctx, a, "vm.*.shutdown", "", start)
+	check(t, err)
+	if added != 2 {
+		t.Fatalf("Expected the two messages matching the pattern to be replayed, added %d", added)
+	}
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{eu, us}) {
+		t.Fatalf("Expected messages %d and %d pending after replay, got %v", eu, us, got)
+	}
+
+	added, err = s.DeliverRetained(ctx, b, "vm.>", "")
+	check(t, err)
+	if added != 3 {
+		t.Fatalf("Expected the three retained values matching the pattern to be delivered, added %d", added)
+	}
+}
+
+func testGroups(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b, c := newID(t), newID(t), newID(t)
+	check(t, s.AddSubscription(ctx, a, tolliver.Subscription{Channel: "jobs", Group: "workers"}))
+	check(t, s.AddSubscription(ctx, b, tolliver.Subscription{Channel: "jobs", Group: "workers"}))
+	check(t, s.AddSubscription(ctx, b, tolliver.Subscription{Channel: "jobs", Key: "k", Group: "workers"}))
+	check(t, s.AddSubscription(ctx, c, tolliver.Subscription{Channel: "jobs"}))
+	check(t, s.AddSubscription(ctx, c, tolliver.Subscription{Channel: "jobs.>", Group: "auditors"}))
+
+	subscribers, err := s.Subscribers(ctx, "jobs", "k")
+	check(t, err)
+	if !sameSet(subscribers, []uuid.UUID{c}) {
+		t.Fatalf("Expected only the subscriber outside any group, got %v", subscribers)
+	}
+	groups, err := s.Groups(ctx, "jobs", "k")
+	check(t, err)
+	want := []uuid.UUID{a, b}
+	slices.SortFunc(want, func(x, y uuid.UUID) int { return bytes.Compare(x[:], y[:]) })
+	if len(groups) != 1 || !slices.Equal(groups["workers"], want) {
+		t.Fatalf("Expected workers %v ordered by UUID, got %v", want, groups)
+	}
+	groups, err = s.Groups(ctx, "jobs.eu", "k")
+	check(t, err)
+	if len(groups) != 1 || !slices.Equal(groups["auditors"], []uuid.UUID{c}) {
+		t.Fatalf("Expected the auditors group to match the pattern, got %v", groups)
+	}
+
+	check(t, s.RemoveSubscription(ctx, a, tolliver.Subscription{Channel: "jobs", Group: "workers"}))
+	groups, err = s.Groups(ctx, "jobs", "k")
+	check(t, err)
+	if !slices.Equal(groups["workers"], []uuid.UUID{b}) {
+		t.Fatalf("Expected b to be left in the group, got %v", groups)
+	}
+
+	start := now()
+	id, _, err := s.SaveMessage(ctx, tolliver.StoredMessage{Channel: "jobs", SavedAt: start}, []tolliver.Recipient{{Remote: a, Group: "workers"}, {Remote: c}})
+	check(t, err)
+	due, err := s.DueGroupDeliveries(ctx, start)
+	check(t, err)
+	if len(due) != 1 || due[0].Recipient != a || due[0].Group != "workers" {
+		t.Fatalf("Expected only the delivery to the group member to be due, got %+v", due)
+	}
+	check(t, s.RecordAttempt(ctx, id, a, start, start.Add(time.Minute)))
+	if due, err := s.DueGroupDeliveries(ctx, start); err != nil || len(due) != 0 {
+		t.Fatalf("Delivery which isn't due again was returned: %+v, %v", due, err)
+	}
+
+	moved, err := s.Reassign(ctx, id, a, c)
+	check(t, err)
+	if moved {
+		t.Fatal("Delivery was moved to a recipient which already has one for the message")
+	}
+	moved, err = s.Reassign(ctx, id, a, b)
+	check(t, err)
+	if !moved {
+		t.Fatal("Delivery was not moved")
+	}
+	if len(pending(t, s, a)) != 0 {
+		t.Fatal("Moved delivery is still pending for the old recipient")
+	}
+	got := pending(t, s, b)
+	if len(got) != 1 || got[0].Attempts != 1 || got[0].Group != "workers" {
+		t.Fatalf("Expected the moved delivery to keep its attempts and group, got %+v", got)
+	}
+	if due, err := s.DueGroupDeliveries(ctx, start); err != nil || len(due) != 1 {
+		t.Fatalf("Expected the moved delivery to be due straight away, got %+v, %v", due, err)
+	}
+
+	letters, err := s.Reject(ctx, id, b, "busy", start)
+	check(t, err)
+	if len(letters) != 1 {
+		t.Fatalf("Expected one dead letter, got %+v", letters)
+	}
+	requeued, err := s.Requeue(ctx, letters[0].ID, start)
+	check(t, err)
+	if got := pending(t, s, b); !requeued || len(got) != 1 || got[0].Group != "workers" {
+		t.Fatalf("Expected the requeued delivery to stay in its group, got %+v", got)
+	}
+}
+
+func testLocalSubscriptions(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	for _, sub := range []tolliver.Subscription{{Channel: "b", Key: "1"}, {Channel: "a", Key: ""}, {Channel: "c", Key: "2"}, {Channel: "c", Key: "2", Group: "g"}} {
+		added, err := s.AddLocalSubscription(ctx, sub)
+		check(t, err)
+		if !added {
+			t.Fatalf("New subscription %+v was reported as existing", sub)
+		}
+	}
+	added, err := s.AddLocalSubscription(ctx, tolliver.Subscription{Channel: "a", Key: ""})
+	check(t, err)
+	if added {
+		t.Fatal("Existing subscription was reported as new")
+	}
+
+	check(t, s.RemoveLocalSubscription(ctx, tolliver.Subscription{Channel: "a", Key: ""}))
+	check(t, s.RemoveLocalSubscription(ctx, tolliver.Subscription{Channel: "missing", Key: ""}))
+
+	got, err := s.LocalSubscriptions(ctx)
+	check(t, err)
+	want := []tolliver.Subscription{{Channel: "b", Key: "1"}, {Channel: "c", Key: "2"}, {Channel: "c", Key: "2", Group: "g"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Expected local subscriptions %v in the order added, got %v", want, got)
+	}
+}
+
+func testInbox(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	start := now()
+
+	processed := func(sender uuid.UUID, id uint64, want bool) {
+		t.Helper()
+		got, err := s.Processed(ctx, sender, id)
+		check(t, err)
+		if got != want {
+			t.Fatalf("Expected message %d from %v processed to be %v", id, sender, want)
+		}
+	}
+
+	check(t, s.MarkProcessed(ctx, a, 1, start))
+	check(t, s.MarkProcessed(ctx, a, 2, start.Add(time.Minute)))
+	processed(a, 1, true)
+	processed(b, 1, false)
+	processed(a, 3, false)
+
+	check(t, s.PruneInbox(ctx, start.Add(time.Second)))
+	processed(a, 1, false)
+	processed(a, 2, true)
+}
+
+func testCertificatePins(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	old, renewed := tolliver.Fingerprint{1}, tolliver.Fingerprint{2}
+
+	pinned := func(remote uuid.UUID, fp tolliver.Fingerprint, want bool) {
+		t.Helper()
+		got, err := s.CertificatePinned(ctx, remote, fp)
+		check(t, err)
+		if got != want {
+			t.Fatalf("Expected %v pinned for %v to be %v", fp, remote, want)
+		}
+	}
+
+	check(t, s.PinCertificate(ctx, a, old))
+	check(t, s.PinCertificate(ctx, a, old))
+	check(t, s.PinCertificate(ctx, a, renewed))
+	pinned(a, old, true)
+	pinned(a, renewed, true)
+	pinned(b, old, false)
+
+	found, err := s.UnpinCertificate(ctx, a, old)
+	check(t, err)
+	if !found {
+		t.Fatal("Expected the pinned certificate to be found")
+	}
+	pinned(a, old, false)
+	pinned(a, renewed, true)
+	if found, err := s.UnpinCertificate(ctx, b, old); err != nil || found {
+		t.Fatalf("Expected unpinning a certificate which isn't pinned to report false, got %v, %v", found, err)
+	}
+}
+
+func testDeleteUnreferenced(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a := newID(t)
+	start := now()
+	acked, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("1"), SavedAt: start}, a)
+	save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("22"), SavedAt: start})
+	rejected, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("333"), SavedAt: start}, a)
+	pendingID, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("4444"), SavedAt: start}, a)
+	save(t, s, tolliver.StoredMessage{Channel: "c", Body: []byte("55555"), SavedAt: start.Add(time.Hour)})
+	save(t, s, tolliver.StoredMessage{Channel: "kept", Body: []byte("666666"), SavedAt: start})
+	check(t, s.Ack(ctx, acked, a))
+	_, err := s.Reject(ctx, rejected, a, "", start)
+	check(t, err)
+
+	u, err := s.Usage(ctx)
+	check(t, err)
+	if u != (tolliver.StoreUsage{Messages: 6, Bytes: 21}) {
+		t.Fatalf("Expected 6 messages of 21 bytes before deleting, got %+v", u)
+	}
+
+	deleted, err := s.DeleteUnreferenced(ctx, start.Add(time.Second), map[string]time.Time{"kept": start})
+	check(t, err)
+	if deleted != 2 {
+		t.Fatalf("Expected the acked message and the one without recipients to be deleted, deleted %d", deleted)
+	}
+	u, err = s.Usage(ctx)
+	check(t, err)
+	if u != (tolliver.StoreUsage{Messages: 4, Bytes: 18}) {
+		t.Fatalf("Expected 4 messages of 18 bytes after deleting, got %+v", u)
+	}
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{pendingID}) {
+		t.Fatalf("Pending delivery was affected by deleting, got %v", got)
+	}
+	letters, err := s.DeadLetters(ctx, tolliver.DeadLetterFilter{})
+	check(t, err)
+	if len(letters) != 1 || string(letters[0].Body) != "333" {
+		t.Fatalf("Dead letter was affected by deleting, got %+v", letters)
+	}
+
+	deleted, err = s.DeleteUnreferenced(ctx, start.Add(time.Second), nil)
+	check(t, err)
+	if deleted != 1 {
+		t.Fatalf("Expected the message on the channel with its own retention to be deleted, deleted %d", deleted)
+	}
+
+	check(t, s.Compact(ctx))
+}
+
+func testReplay(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	start := now()
+	save(t, s, tolliver.StoredMessage{Channel: "c", Key: "k", SavedAt: start.Add(-time.Second)})
+	acked, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Key: "k", Body: []byte("acked"), SavedAt: start}, a)
+	pendingID, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Key: "k", SavedAt: start}, b)
+	other, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Key: "other", SavedAt: start})
+	save(t, s, tolliver.StoredMessage{Channel: "d", Key: "k", SavedAt: start})
+	save(t, s, tolliver.StoredMessage{Channel: tolliver.ReservedTolliverChannel, SavedAt: start})
+	check(t, s.Ack(ctx, acked, a))
+
+	added, err := s.Replay(ctx, b, "c", "k", start)
+	check(t, err)
+	if added != 1 {
+		t.Fatalf("Expected one delivery to be added alongside the pending one, added %d", added)
+	}
+	if got := messageIDs(pending(t, s, b)); !slices.Equal(got, []uint64{acked, pendingID}) {
+		t.Fatalf("Expected messages %d and %d pending after replay, got %v", acked, pendingID, got)
+	}
+	d := pending(t, s, b)[0]
+	if string(d.Body) != "acked" || d.Attempts != 0 {
+		t.Fatalf("Replayed delivery doesn't match the saved message: %+v", d)
+	}
+	due, err := s.DueDeliveries(ctx, start, []uuid.UUID{b})
+	check(t, err)
+	if len(due) != 2 {
+		t.Fatalf("Replayed delivery isn't due straight away, got %v", messageIDs(due))
+	}
+
+	added, err = s.Replay(ctx, a, "c", "", start)
+	check(t, err)
+	if added != 3 {
+		t.Fatalf("Expected every message on the channel since the start to be replayed, added %d", added)
+	}
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{acked, pendingID, other}) {
+		t.Fatalf("Expected messages %d, %d and %d pending after replay, got %v", acked, pendingID, other, got)
+	}
+}
+
+func testDropOldest(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	body := []byte("0123456789")
+	// Older than everything else, but protocol messages aren't counted or dropped
+	protocol, _ := save(t, s, tolliver.StoredMessage{Channel: tolliver.ReservedTolliverChannel, Body: body}, b)
+	first, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: body}, a, b)
+	second, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: body}, a)
+	third, _ := save(t, s, tolliver.StoredMessage{Channel: "c", Body: body}, a)
+	_, err := s.Reject(ctx, first, b, "", now())
+	check(t, err)
+
+	dropped, err := s.DropOldest(ctx, tolliver.StoreUsage{Messages: 3})
+	check(t, err)
+	if len(dropped) != 0 {
+		t.Fatalf("Dropped deliveries while within the limit: %v", messageIDs(dropped))
+	}
+
+	dropped, err = s.DropOldest(ctx, tolliver.StoreUsage{Messages: 2})
+	check(t, err)
+	if len(dropped) != 1 || dropped[0].MessageID != first || dropped[0].Recipient != a {
+		t.Fatalf("Expected the pending delivery of message %d to be dropped, got %+v", first, dropped)
+	}
+	letters, err := s.DeadLetters(ctx, tolliver.DeadLetterFilter{})
+	check(t, err)
+	if len(letters) != 0 {
+		t.Fatal("Dead letters of a dropped message were kept")
+	}
+
+	dropped, err = s.DropOldest(ctx, tolliver.StoreUsage{Bytes: int64(len(body))})
+	check(t, err)
+	if !slices.Equal(messageIDs(dropped), []uint64{second}) {
+		t.Fatalf("Expected message %d to be dropped to fit the byte limit, got %v", second, messageIDs(dropped))
+	}
+	if got := messageIDs(pending(t, s, a)); !slices.Equal(got, []uint64{third}) {
+		t.Fatalf("Expected only message %d to be left, got %v", third, got)
+	}
+	u, err := s.Usage(ctx)
+	check(t, err)
+	if u != (tolliver.StoreUsage{Messages: 1, Bytes: int64(len(body))}) {
+		t.Fatalf("Expected one message left, got %+v", u)
+	}
+	if got := messageIDs(pending(t, s, b)); !slices.Equal(got, []uint64{protocol}) {
+		t.Fatalf("Expected the protocol message to still be pending, got %v", got)
+	}
+}
+
+func testRetained(t *testing.T, s tolliver.Store) {
+	ctx := context.Background()
+	a, b := newID(t), newID(t)
+	start := now()
+	save(t, s, tolliver.StoredMessage{Channel: "status", Key: "x", Body: []byte("old"), SavedAt: start, Retain: true})
+	latest, _ := save(t, s, tolliver.StoredMessage{Channel: "status", Key: "x", Body: []byte("new"), SavedAt: start, Retain: true}, a)
+	cleared, _ := save(t, s, tolliver.StoredMessage{Channel: "status", Key: "y", Body: []byte("gone"), SavedAt: start, Retain: true})
+	save(t, s, tolliver.StoredMessage{Channel: "status", Key: "y", SavedAt: start, Retain: true})
+	other, _ := save(t, s, tolliver.StoredMessage{Channel: "config", Key: "x", Body: []byte("cfg"), SavedAt: start, Retain: true})
+
+	added, err := s.DeliverRetained(ctx, a, "status", "")
+	check(t, err)
+	if added != 0 {
+		t.Fatalf("Retained value already pending for the recipient was added again, added %d", added)
+	}
+	added, err = s.DeliverRetained(ctx, b, "status", "")
+	check(t, err)
+	if added != 1 {
+		t.Fatalf("Expected only the latest value on the channel to be delivered, added %d", added)
+	}
+	if got := pending(t, s, b); len(got) != 1 || got[0].MessageID != latest || string(got[0].Body) != "new" {
+		t.Fatalf("Expected the latest retained value %d to be pending, got %+v", latest, got)
+	}
+	added, err = s.DeliverRetained(ctx, b, "", "x")
+	check(t, err)
+	if added != 1 {
+		t.Fatalf("Expected the retained value on the other channel to be delivered, added %d", added)
+	}
+	if got := messageIDs(pending(t, s, b)); !slices.Equal(got, []uint64{latest, other}) {
+		t.Fatalf("Expected messages %d and %d pending, got %v", latest, other, got)
+	}
+
+	// Retained values outlive their deliveries, while replaced and cleared ones are collected like any other message
+	check(t, s.Ack(ctx, latest, a))
+	check(t, s.Ack(ctx, latest, b))
+	check(t, s.Ack(ctx, other, b))
+	deleted, err := s.DeleteUnreferenced(ctx, start.Add(time.Second), nil)
+	check(t, err)
+	if deleted != 3 {
+		t.Fatalf("Expected the replaced value, the cleared value and the clearing message to be deleted, deleted %d", deleted)
+	}
+	added, err = s.DeliverRetained(ctx, a, "", "")
+	check(t, err)
+	if added != 2 {
+		t.Fatalf("Expected both retained values to survive collection, added %d", added)
+	}
+	for _, d := range pending(t, s, a) {
+		if d.MessageID == cleared {
+			t.Fatal("Cleared retained value was delivered")
+		}
+	}
+
+	dropped, err := s.DropOldest(ctx, tolliver.StoreUsage{Messages: 1})
+	check(t, err)
+	if len(dropped) != 1 || dropped[0].MessageID != latest {
+		t.Fatalf("Expected the oldest retained value to be dropped, got %v", messageIDs(dropped))
+	}
+	added, err = s.DeliverRetained(ctx, b, "status", "")
+	check(t, err)
+	if added != 0 {
+		t.Fatal("Dropped retained value was delivered")
+	}
+}
@@ -0,0 +1,106 @@
+package tolliver
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/tug-dev/tolliver/go/internal/match"
+)
+
+// The subscriptions of every remote, indexed by channel pattern so that finding who a message goes to doesn't mean
+// checking every subscription. Safe for concurrent use.
+type subscriberIndex struct {
+	l        sync.Mutex
+	channels match.Trie[subscriber]
+	byRemote map[uuid.UUID]map[Subscription]struct{}
+}
+
+type subscriber struct {
+	remote uuid.UUID
+	key    string
+	group  string
+}
+
+func newSubscriberIndex() *subscriberIndex {
+	return &subscriberIndex{byRemote: make(map[uuid.UUID]map[Subscription]struct{})}
+}
+
+func (x *subscriberIndex) add(remote uuid.UUID, sub Subscription) {
+	x.l.Lock()
+	defer x.l.Unlock()
+
+	if x.byRemote[remote] == nil {
+		x.byRemote[remote] = make(map[Subscription]struct{})
+	}
+	x.byRemote[remote][sub] = struct{}{}
+	x.channels.Add(sub.Channel, subscriber{remote: remote, key: sub.Key, group: sub.Group})
+}
+
+func (x *subscriberIndex) remove(remote uuid.UUID, sub Subscription) {
+	x.l.Lock()
+	defer x.l.Unlock()
+
+	x.removeLocked(remote, sub)
+}
+
+func (x *subscriberIndex) removeLocked(remote uuid.UUID, sub Subscription) {
+	delete(x.byRemote[remote], sub)
+	x.channels.Remove(sub.Channel, subscriber{remote: remote, key: sub.Key, group: sub.Group})
+}
+
+func (x *subscriberIndex) replace(remote uuid.UUID, subs []Subscription) {
+	x.l.Lock()
+	defer x.l.Unlock()
+
+	for sub := range x.byRemote[remote] {
+		x.removeLocked(remote, sub)
+	}
+	set := make(map[Subscription]struct{}, len(subs))
+	for _, sub := range subs {
+		set[sub] = struct{}{}
+		x.channels.Add(sub.Channel, subscriber{remote: remote, key: sub.Key, group: sub.Group})
+	}
+	x.byRemote[remote] = set
+}
+
+// Returns the remotes with a subscription outside any queue group matching the channel and key, each once.
+func (x *subscriberIndex) match(channel, key string) []uuid.UUID {
+	x.l.Lock()
+	defer x.l.Unlock()
+
+	var out []uuid.UUID
+	seen := make(map[uuid.UUID]struct{})
+	for _, s := range x.channels.Match(channel) {
+		if s.group != "" || (s.key != "" && s.key != key) {
+			continue
+		}
+		if _, ok := seen[s.remote]; ok {
+			continue
+		}
+		seen[s.remote] = struct{}{}
+		out = append(out, s.remote)
+	}
+	return out
+}
+
+// Returns the members of each queue group with a subscription matching the channel and key, ordered by UUID.
+func (x *subscriberIndex) groups(channel, key string) map[string][]uuid.UUID {
+	x.l.Lock()
+	defer x.l.Unlock()
+
+	out := make(map[string][]uuid.UUID)
+	for _, s := range x.channels.Match(channel) {
+		if s.group == "" || (s.key != "" && s.key != key) || slices.Contains(out[s.group], s.remote) {
+			continue
+		}
+		out[s.group] = append(out[s.group], s.remote)
+	}
+	for _, members := range out {
+		slices.SortFunc(members, func(a, b uuid.UUID) int {
+			return bytes.Compare(a[:], b[:])
+		})
+	}
+	return out
+}
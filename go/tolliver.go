@@ -1,6 +1,7 @@
 package tolliver
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
@@ -11,7 +12,6 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/tug-dev/tolliver/go/internal/db"
 	_ "modernc.org/sqlite"
 )
 
@@ -24,21 +24,84 @@ type InstanceOptions struct {
 	// Path to the desired database file, defaults to "./tolliver.sqlite"
 	DatabasePath string
 
-	// Reference to the desired CAs to use to authenticate remotes. This is required
+	// An already open SQLite database to use instead of opening DatabasePath, which allows messages to be saved inside
+	// the application's own transactions with Instance.SendTx. The instance creates its tables in it if they don't exist
+	// and doesn't close it. Since SQLite only allows a single writer, the database should either be limited to one open
+	// connection or have a busy timeout set.
+	Database *sql.DB
+
+	// Where to persist messages, subscriptions and the instance's identity, used instead of Database and DatabasePath.
+	// The instance doesn't close it.
+	Store Store
+
+	// Reference to the desired CAs to use to authenticate remotes. This is required unless Credentials.CAFile is set
 	CA *x509.CertPool
 
-	// Certificate to present to remotes during TLS handshake. This is required
+	// Certificate to present to remotes during TLS handshake. This is required unless Credentials.CertFile is set.
+	// Remotes check it against their CA both when this instance dials them and when they dial this instance, so it must
+	// be valid for client and server authentication and for the names remotes dial it by.
 	InstanceCert *tls.Certificate
 
+	// Where to reload the certificate and CA from while the instance is running, see CredentialPolicy
+	Credentials CredentialPolicy
+
+	// Disables checking the certificates of remotes against CA and the names they were dialled by, so that any remote
+	// with a certificate can connect to and be connected to by this instance. Remotes still have to present a
+	// certificate, but anyone can make one, so this leaves the instance open to everyone on the network. Only for
+	// development, never set it in production.
+	InsecureSkipVerify bool
+
+	// Which UUIDs remotes may claim given the certificates they present, see IdentityPolicy. By default any UUID is
+	// trusted.
+	Identity IdentityPolicy
+
+	// Decides what each remote may publish to and subscribe to on this instance, see Authorizer. By default remotes may
+	// do anything.
+	Authorizer Authorizer
+
 	// Interface to listen on (e.g. 127.0.0.1, 0.0.0.0)
 	Interface string
 
 	// Port to listen on. If 0, a server will not be started and the interface will act purely as a client.
 	Port uint16
 
-	// Interval to try resend messages after
+	// How often to check for unacked messages which are due to be resent, defaults to one second
 	RetryInterval time.Duration
 
+	// How long a remote which connects to this instance has to complete the TLS and tolliver handshakes before it is
+	// disconnected, and how long this instance waits for them when dialing a remote in the background, defaults to ten
+	// seconds
+	HandshakeTimeout time.Duration
+
+	// How long to wait before resending each unacked message, see BackoffPolicy for the defaults
+	Backoff BackoffPolicy
+
+	// Number of times to send a reliable message to a remote before giving up and moving it to the dead letter queue.
+	// If 0 messages are resent until they are acked, nacked or expire.
+	MaxAttempts int
+
+	// How long to remember reliable messages from remotes after acking them. While a message is remembered, copies the
+	// sender resends because the ack was lost are acked again without being passed to handlers. If 0 duplicates are
+	// passed to handlers like any other message. This should be longer than senders keep resending unacked messages.
+	DedupWindow time.Duration
+
+	// Called when a remote nacks a reliable message sent by this instance. The message will not be resent to that
+	// remote and is moved to the dead letter queue.
+	OnRejected func(Rejection)
+
+	// Called when a reliable message sent with WithTTL or WithDeadline expires before a remote acked it. The message
+	// will no longer be resent to that remote and is moved to the dead letter queue.
+	OnExpired func(Expiry)
+
+	// Called whenever a delivery is moved to the dead letter queue, whatever the reason. Dead letters can be listed,
+	// requeued and purged through the Instance.
+	OnDeadLetter func(DeadLetter)
+
+	// How long to keep saved messages and how much space they may take up, see RetentionPolicy for the defaults
+	Retention RetentionPolicy
+
+	// Logger for errors which happen in the background and so can't be returned to the caller, defaults to
+	// slog.Default()
 	Logger slog.Logger
 }
 
@@ -49,34 +112,161 @@ func NewInstance(opts *InstanceOptions) (*Instance, error) {
 	}
 
 	i := Instance{
-		certs:     []tls.Certificate{*opts.InstanceCert},
-		authority: opts.CA,
-		logger:    opts.Logger,
+		cert:         opts.InstanceCert,
+		authority:    opts.CA,
+		credentials:  opts.Credentials,
+		insecure:     opts.InsecureSkipVerify,
+		identity:     opts.Identity,
+		authorizer:   opts.Authorizer,
+		logger:       opts.Logger,
+		onRejected:   opts.OnRejected,
+		onExpired:    opts.OnExpired,
+		onDeadLetter: opts.OnDeadLetter,
+		maxAttempts:  opts.MaxAttempts,
+		dedupWindow:  opts.DedupWindow,
+		backoff:      opts.Backoff,
+		retention:    opts.Retention,
+	}
+
+	if i.insecure {
+		i.logger.Warn("TLS verification of remotes is disabled, any remote with a certificate can connect")
 	}
 
-	database, err := sql.Open("sqlite", opts.DatabasePath)
+	switch {
+	case opts.Store != nil:
+		i.store = opts.Store
+	case opts.Database != nil:
+		i.store, err = NewSQLiteStore(context.Background(), opts.Database)
+	default:
+		i.store, err = OpenSQLiteStore(context.Background(), opts.DatabasePath)
+		i.ownsStore = true
+	}
 	if err != nil {
-		return &Instance{}, err
+		return &Instance{}, persistError(err)
 	}
 
-	i.id = db.Init(database)
-	i.db = database
+	i.id, err = i.store.InstanceID(context.Background())
+	if err != nil {
+		i.closeStore()
+		return &Instance{}, persistError(err)
+	}
+	subs, err := i.store.LocalSubscriptions(context.Background())
+	if err != nil {
+		i.closeStore()
+		return &Instance{}, persistError(err)
+	}
+	i.subs = toSubscriptionInfos(subs)
+	i.usage, err = i.store.Usage(context.Background())
+	if err != nil {
+		i.closeStore()
+		return &Instance{}, persistError(err)
+	}
 
 	i.conns = make(map[uuid.UUID]net.Conn)
-	go i.retry(opts.RetryInterval)
+	i.handshaking = make(map[net.Conn]struct{})
+	i.handshakeTimeout = opts.HandshakeTimeout
+	i.dialed = make(map[uuid.UUID]RemoteAddr)
+	i.retryInterval = opts.RetryInterval
+	i.ctx, i.cancel = context.WithCancel(context.Background())
+	i.done = make(chan struct{})
 
 	if opts.Port != 0 {
-		i.listenOn(opts.Interface + ":" + strconv.Itoa(int(opts.Port)))
+		err = i.listenOn(opts.Interface + ":" + strconv.Itoa(int(opts.Port)))
+		if err != nil {
+			i.cancel()
+			i.closeStore()
+			return &Instance{}, err
+		}
+	}
+
+	i.wg.Add(2)
+	go i.retry(opts.RetryInterval)
+	go i.collect()
+	if len(opts.Credentials.files()) > 0 || opts.Credentials.RecheckPeers {
+		i.wg.Add(1)
+		go i.watchCredentials()
 	}
 
 	for _, r := range opts.Remotes {
-		i.NewConnection(r)
+		i.wg.Add(1)
+		go i.keepDialing(r, opts.RetryInterval)
 	}
 
 	return &i, nil
 }
 
+// Stops the instance. The listener is closed and the retry loop stopped straight away, then Close waits for any
+// callbacks which are currently processing a message before closing every connection and finally the database, unless
+// it was passed in through InstanceOptions.Database or InstanceOptions.Store. Messages which arrive while the instance
+// is draining are not passed to callbacks and are left unacked, so the sender will redeliver them later.
+//
+// If ctx is done before the instance has finished draining, the remaining connections and the database are closed
+// anyway and the context's error is returned. Calling Close more than once returns ErrClosed.
+func (inst *Instance) Close(ctx context.Context) error {
+	inst.l.Lock()
+	if inst.closed {
+		inst.l.Unlock()
+		return ErrClosed
+	}
+	inst.closed = true
+	close(inst.done)
+	inst.l.Unlock()
+
+	if inst.listener != nil {
+		inst.listener.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		inst.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+	inst.cancel()
+
+	inst.l.Lock()
+	for id, c := range inst.conns {
+		c.Close()
+		delete(inst.conns, id)
+	}
+	for c := range inst.handshaking {
+		c.Close()
+	}
+	inst.l.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		inst.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+
+	storeErr := inst.closeStore()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storeErr
+}
+
+// Closes the store, unless it was passed in through InstanceOptions.Store or InstanceOptions.Database and so belongs to
+// the application.
+func (inst *Instance) closeStore() error {
+	if !inst.ownsStore {
+		return nil
+	}
+	return inst.store.Close()
+}
+
 func populateDefaults(options *InstanceOptions) error {
+	if err := options.Credentials.populateDefaults(options); err != nil {
+		return err
+	}
 	if options.CA == nil || options.InstanceCert == nil {
 		return InvalidInstanceOptions
 	}
@@ -86,11 +276,20 @@ func populateDefaults(options *InstanceOptions) error {
 	if options.RetryInterval == 0 {
 		options.RetryInterval = time.Second
 	}
+	if options.HandshakeTimeout == 0 {
+		options.HandshakeTimeout = 10 * time.Second
+	}
+	options.Backoff.populateDefaults(options.RetryInterval)
+	options.Retention.populateDefaults()
+	if options.Logger.Handler() == nil {
+		options.Logger = *slog.Default()
+	}
 
 	return nil
 }
 
 type RemoteAddr struct {
 	net.Addr
+	// Name the remote's certificate must be valid for, defaults to the host of Addr
 	ServerName string
 }
@@ -1,18 +1,35 @@
 package tolliver_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	tolliver "github.com/tug-dev/tolliver/go"
+	"github.com/tug-dev/tolliver/go/internal/binary"
+	"github.com/tug-dev/tolliver/go/internal/handshake"
+	"github.com/tug-dev/tolliver/go/storetest"
 )
 
-// TODO: Check about mTLS
 // TODO: Switch to buffer pool
 // TODO: Add mutexes because currently not thread safe
 
@@ -34,51 +51,1951 @@ func TestHandshake(t *testing.T) {
 		t.Error("Could not parse root cert")
 	}
 
-	println("Loaded certs")
-
 	inst1, err := tolliver.NewInstance(&tolliver.InstanceOptions{
 		Interface:    "127.0.0.1",
 		Port:         8000,
 		CA:           caPool,
 		InstanceCert: &cert1,
-		DatabasePath: "inst1.db",
+		DatabasePath: filepath.Join(t.TempDir(), "inst1.db"),
 	})
 	if err != nil {
 		t.Error(err)
 	}
+	defer inst1.Close(context.Background())
 
 	inst2, err := tolliver.NewInstance(&tolliver.InstanceOptions{
 		Interface:    "127.0.0.1",
 		Port:         9000,
 		CA:           caPool,
 		InstanceCert: &cert2,
-		DatabasePath: "inst2.db",
+		DatabasePath: filepath.Join(t.TempDir(), "inst2.db"),
 	})
 	if err != nil {
 		t.Error(err)
 	}
+	defer inst2.Close(context.Background())
+
+	err = inst1.NewConnection(context.Background(), tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9000}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = inst2.Subscribe(context.Background(), "test", "key")
+	if err != nil {
+		t.Error(err)
+	}
 
-	println("Created instances")
+	inst2.Register("test", "key", func(m []byte) bool {
+		t.Logf("Received message: %s", m)
+		return true
+	})
+	time.Sleep(1 * time.Millisecond)
 
-	err = inst1.NewConnection(tolliver.RemoteAddr{&net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9000}, ""})
+	err = inst1.Send(context.Background(), "test", "key", []byte("Hello World!"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	println("Connected instances")
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestHandshakeOldVersion(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	newTestInstance(t, caPool, cert2, 9035)
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:9035", &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{cert1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Version 3 subscriptions have no queue group
+	w := binary.NewWriter()
+	w.WriteAll(handshake.HandshakeReqMessageCode, uint64(3), uuid.Must(uuid.NewV7()), uint64(1), uint64(len("jobs")), "jobs", uint64(0), "")
+	if _, err := conn.Write(w.Join()); err != nil {
+		t.Fatal(err)
+	}
+
+	var code, status byte
+	var version uint64
+	var id uuid.UUID
+	if err := binary.NewReader(conn).ReadAll(nil, &code, &version, &id, &status); err != nil {
+		t.Fatalf("Expected a handshake response, got %v", err)
+	}
+	if code != handshake.HandshakeResMessageCode || status != handshake.HandshakeIncompatible {
+		t.Errorf("Expected the handshake to be rejected as incompatible, got code %d status %d", code, status)
+	}
+}
+
+func testCredentials(t *testing.T) (*x509.CertPool, tls.Certificate, tls.Certificate) {
+	t.Helper()
+	cert1, err := tls.LoadX509KeyPair("./testData/instance1.crt", "./testData/instance1.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert2, err := tls.LoadX509KeyPair("./testData/instance2.crt", "./testData/instance2.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile("./testData/root.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPool := x509.NewCertPool()
+	if ok := caPool.AppendCertsFromPEM(caPEM); !ok {
+		t.Fatal("Could not parse root cert")
+	}
+
+	return caPool, cert1, cert2
+}
 
-	inst2.Subscribe("test", "key")
+func TestClose(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
 
-	println("Sent subscription")
+	inst1, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		Interface:    "127.0.0.1",
+		Port:         8001,
+		CA:           caPool,
+		InstanceCert: &cert1,
+		DatabasePath: filepath.Join(t.TempDir(), "inst1.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst2, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		Interface:    "127.0.0.1",
+		Port:         9001,
+		CA:           caPool,
+		InstanceCert: &cert2,
+		DatabasePath: filepath.Join(t.TempDir(), "inst2.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst1.Close(context.Background())
 
+	started := make(chan struct{})
+	release := make(chan struct{})
+	inst2.Subscribe(context.Background(), "test", "key")
 	inst2.Register("test", "key", func(m []byte) bool {
-		fmt.Printf("Received message: %s\n", string(m))
+		close(started)
+		<-release
 		return true
 	})
-	time.Sleep(1 * time.Millisecond)
-
-	inst1.Send("test", "key", []byte("Hello World!"))
 
-	println("Sent message")
+	err = inst1.NewConnection(context.Background(), tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9001}})
+	if err != nil {
+		t.Fatal(err)
+	}
 	time.Sleep(50 * time.Millisecond)
+	if err := inst1.Send(context.Background(), "test", "key", []byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Callback was not called")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- inst2.Close(context.Background())
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the in-flight callback finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the callback finished")
+	}
+
+	if err := inst2.Close(context.Background()); !errors.Is(err, tolliver.ErrClosed) {
+		t.Errorf("Expected ErrClosed from second Close, got %v", err)
+	}
+	if err := inst2.NewConnection(context.Background(), tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 8001}}); !errors.Is(err, tolliver.ErrClosed) {
+		t.Errorf("Expected ErrClosed from NewConnection, got %v", err)
+	}
+
+	lst, err := net.Listen("tcp", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("Port was not released by Close: %v", err)
+	}
+	lst.Close()
+}
+
+func TestStalledHandshake(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+
+	server, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		Interface:    "127.0.0.1",
+		Port:         9032,
+		CA:           caPool,
+		InstanceCert: &cert2,
+		DatabasePath: filepath.Join(t.TempDir(), "server.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		CA:           caPool,
+		InstanceCert: &cert1,
+		DatabasePath: filepath.Join(t.TempDir(), "client.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(context.Background())
+
+	// A remote which connects but never sends a handshake mustn't stop others from connecting
+	stalled, err := net.Dial("tcp", "127.0.0.1:9032")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.NewConnection(ctx, tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9032}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor stop Close from returning
+	closed := make(chan error)
+	go func() {
+		closed <- server.Close(context.Background())
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return while a handshake was pending")
+	}
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Close left the pending connection open")
+	}
+
+	// And a remote which takes too long over its handshake is disconnected
+	impatient, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		Interface:        "127.0.0.1",
+		Port:             9033,
+		CA:               caPool,
+		InstanceCert:     &cert2,
+		DatabasePath:     filepath.Join(t.TempDir(), "impatient.db"),
+		HandshakeTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impatient.Close(context.Background())
+	slow, err := net.Dial("tcp", "127.0.0.1:9033")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := slow.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Remote was not disconnected when its handshake timed out")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	caPool, cert1, _ := testCredentials(t)
+
+	inst, err := tolliver.NewInstance(&tolliver.InstanceOptions{
+		CA:           caPool,
+		InstanceCert: &cert1,
+		DatabasePath: filepath.Join(t.TempDir(), "inst.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close(context.Background())
+
+	ctx := context.Background()
+	if err := inst.Subscribe(ctx, tolliver.ReservedTolliverChannel, ""); !errors.Is(err, tolliver.ErrReservedChannel) {
+		t.Errorf("Expected ErrReservedChannel from Subscribe, got %v", err)
+	}
+	if err := inst.Send(ctx, tolliver.ReservedTolliverChannel, "", nil); !errors.Is(err, tolliver.ErrReservedChannel) {
+		t.Errorf("Expected ErrReservedChannel from Send, got %v", err)
+	}
+
+	// Nothing is listening on this port
+	err = inst.NewConnection(ctx, tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9002}})
+	var dialErr *tolliver.DialError
+	if !errors.As(err, &dialErr) {
+		t.Errorf("Expected a DialError, got %v", err)
+	}
+
+	_, err = tolliver.NewInstance(&tolliver.InstanceOptions{
+		DatabasePath: filepath.Join(t.TempDir(), "inst.db"),
+	})
+	if !errors.Is(err, tolliver.InvalidInstanceOptions) {
+		t.Errorf("Expected InvalidInstanceOptions, got %v", err)
+	}
+}
+
+// Creates an instance listening on port, if it is non zero, which is closed when the test finishes.
+func newTestInstance(t *testing.T, caPool *x509.CertPool, cert tls.Certificate, port uint16, configure ...func(*tolliver.InstanceOptions)) *tolliver.Instance {
+	t.Helper()
+	opts := &tolliver.InstanceOptions{
+		Interface:     "127.0.0.1",
+		Port:          port,
+		CA:            caPool,
+		InstanceCert:  &cert,
+		DatabasePath:  filepath.Join(t.TempDir(), "inst.db"),
+		RetryInterval: 20 * time.Millisecond,
+	}
+	for _, c := range configure {
+		c(opts)
+	}
+	inst, err := tolliver.NewInstance(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		inst.Close(ctx)
+	})
+
+	return inst
+}
+
+func connect(t *testing.T, from *tolliver.Instance, port int) {
+	t.Helper()
+	err := from.NewConnection(context.Background(), tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: port}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the listening side time to finish its half of the handshake
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestRegisterHandler(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	inst1 := newTestInstance(t, caPool, cert1, 0)
+	inst2 := newTestInstance(t, caPool, cert2, 9003)
+	ctx := context.Background()
+
+	received := make(chan *tolliver.Message, 1)
+	if err := inst2.Subscribe(ctx, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	err := inst2.RegisterHandler("", "", func(ctx context.Context, m *tolliver.Message) error {
+		received <- m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, inst1, 9003)
+
+	if err := inst1.Send(ctx, "test", "some-key", []byte("body"), tolliver.WithHeader("trace", "abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-received:
+		if m.Channel != "test" || m.Key != "some-key" || string(m.Body) != "body" {
+			t.Errorf("Unexpected message %+v", m)
+		}
+		if m.Sender != inst1.ID() {
+			t.Errorf("Expected sender %s, got %s", inst1.ID(), m.Sender)
+		}
+		if !m.Reliable || m.ID == 0 {
+			t.Errorf("Expected a reliable message with an id, got %+v", m)
+		}
+		if m.Headers["trace"] != "abc" {
+			t.Errorf("Expected trace header, got %v", m.Headers)
+		}
+		if m.ReceivedAt.IsZero() {
+			t.Error("ReceivedAt was not set")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not received")
+	}
+}
+
+func TestManualAck(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	rejected := make(chan tolliver.Rejection, 1)
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.OnRejected = func(r tolliver.Rejection) {
+			rejected <- r
+		}
+	})
+	inst2 := newTestInstance(t, caPool, cert2, 9004)
+	ctx := context.Background()
+
+	owned := make(chan *tolliver.Message, 1)
+	inst2.Subscribe(ctx, "jobs", "")
+	inst2.RegisterHandler("jobs", "", func(ctx context.Context, m *tolliver.Message) error {
+		select {
+		case owned <- m:
+			return tolliver.ErrManualAck
+		default:
+			// Leave resends which the test isn't waiting for unacked
+			return errors.New("busy")
+		}
+	})
+	connect(t, inst1, 9004)
+
+	if err := inst1.Send(ctx, "jobs", "", []byte("job")); err != nil {
+		t.Fatal(err)
+	}
+
+	var m *tolliver.Message
+	select {
+	case m = <-owned:
+	case <-time.After(time.Second):
+		t.Fatal("Message was not received")
+	}
+
+	// The message is unsettled so the sender keeps resending it
+	select {
+	case resent := <-owned:
+		resent.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("Unsettled message was not resent")
+	}
+
+	go m.Nack("cannot run job")
+
+	select {
+	case r := <-rejected:
+		if r.Recipient != inst2.ID() || r.MessageID != m.ID || r.Reason != "cannot run job" {
+			t.Errorf("Unexpected rejection %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Rejection was not reported to the sender")
+	}
+
+	if err := m.Ack(); !errors.Is(err, tolliver.ErrAlreadySettled) {
+		t.Errorf("Expected ErrAlreadySettled, got %v", err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := tolliver.BackoffPolicy{Initial: time.Second, Multiplier: 2, Max: 5 * time.Second, Jitter: -1}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if d := b.Delay(i + 1); d != e {
+			t.Errorf("Attempt %d: expected %v, got %v", i+1, e, d)
+		}
+	}
+
+	b.Jitter = 0.5
+	for range 100 {
+		if d := b.Delay(1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("Jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.RetryInterval = 10 * time.Millisecond
+		o.Backoff = tolliver.BackoffPolicy{Initial: 150 * time.Millisecond, Multiplier: 10, Jitter: -1}
+	})
+	inst2 := newTestInstance(t, caPool, cert2, 9005)
+	ctx := context.Background()
+
+	var received atomic.Int32
+	inst2.Subscribe(ctx, "slow", "")
+	inst2.Register("slow", "", func(b []byte) bool {
+		received.Add(1)
+		return false
+	})
+	connect(t, inst1, 9005)
+
+	if err := inst1.Send(ctx, "slow", "", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+
+	// One immediate send and one resend after 150ms, the next isn't due until 1.65s
+	time.Sleep(400 * time.Millisecond)
+	if n := received.Load(); n != 2 {
+		t.Errorf("Expected 2 deliveries, got %d", n)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	expired := make(chan tolliver.Expiry, 1)
+	rejected := make(chan tolliver.Rejection, 1)
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		// Only send once, since a resend arriving after the deadline would be nacked rather than expire
+		o.Backoff.Initial = time.Hour
+		o.OnExpired = func(e tolliver.Expiry) {
+			expired <- e
+		}
+		o.OnRejected = func(r tolliver.Rejection) {
+			rejected <- r
+		}
+	})
+	inst2 := newTestInstance(t, caPool, cert2, 9006)
+	ctx := context.Background()
+
+	var handled atomic.Int32
+	inst2.Subscribe(ctx, "ttl", "")
+	inst2.RegisterHandler("ttl", "", func(ctx context.Context, m *tolliver.Message) error {
+		handled.Add(1)
+		if m.ExpiresAt.IsZero() {
+			t.Error("ExpiresAt was not set on the received message")
+		}
+		return errors.New("not now")
+	})
+	connect(t, inst1, 9006)
+
+	if err := inst1.Send(ctx, "ttl", "k", []byte("body"), tolliver.WithTTL(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-expired:
+		if e.Recipient != inst2.ID() || e.Channel != "ttl" || e.Key != "k" {
+			t.Errorf("Unexpected expiry %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expiry was not reported")
+	}
+	if handled.Load() == 0 {
+		t.Error("Message was never delivered before it expired")
+	}
+
+	// Messages which arrive after their deadline are rejected without reaching handlers
+	handled.Store(0)
+	if err := inst1.Send(ctx, "ttl", "k", []byte("body"), tolliver.WithDeadline(time.Now().Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-rejected:
+		if r.Reason != "expired" {
+			t.Errorf("Unexpected rejection reason %q", r.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stale message was not rejected")
+	}
+	if n := handled.Load(); n != 0 {
+		t.Errorf("Stale message was passed to handlers %d times", n)
+	}
+
+	if err := inst1.Send(ctx, "ttl", "k", nil, tolliver.WithHeader("tolliver-expires", "0")); !errors.Is(err, tolliver.ErrReservedHeader) {
+		t.Errorf("Expected ErrReservedHeader, got %v", err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	dead := make(chan tolliver.DeadLetter, 10)
+	store, err := tolliver.NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Store = store
+		o.MaxAttempts = 2
+		// Far longer than an ack takes to come back, so that acks and nacks always arrive before the message is resent
+		o.Backoff = tolliver.BackoffPolicy{Initial: 250 * time.Millisecond, Multiplier: 1, Jitter: -1}
+		o.OnDeadLetter = func(d tolliver.DeadLetter) {
+			dead <- d
+		}
+	})
+	inst2 := newTestInstance(t, caPool, cert2, 9007)
+	ctx := context.Background()
+
+	var accept atomic.Bool
+	inst2.Subscribe(ctx, "dlq", "")
+	inst2.RegisterHandler("dlq", "", func(ctx context.Context, m *tolliver.Message) error {
+		if m.Key == "reject" {
+			return m.Nack("bad input")
+		}
+		if !accept.Load() {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	connect(t, inst1, 9007)
+
+	if err := inst1.Send(ctx, "dlq", "retry", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	var d tolliver.DeadLetter
+	select {
+	case d = <-dead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exhausted message was not dead lettered")
+	}
+	if d.Reason != tolliver.DeadLetterMaxAttempts || d.Attempts != 2 || d.Recipient != inst2.ID() || string(d.Body) != "body" {
+		t.Errorf("Unexpected dead letter %+v", d)
+	}
+
+	letters, err := inst1.DeadLetters(ctx, tolliver.DeadLetterFilter{Channel: "dlq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != d.ID {
+		t.Fatalf("Expected the dead letter to be listed, got %+v", letters)
+	}
+
+	accept.Store(true)
+	if err := inst1.Requeue(ctx, d.ID); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := store.PendingDeliveries(ctx, inst2.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Requeued message was never acked, still pending %+v", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	letters, err = inst1.DeadLetters(ctx, tolliver.DeadLetterFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 0 {
+		t.Errorf("Expected requeued message to be delivered, got dead letters %+v", letters)
+	}
+	select {
+	case d := <-dead:
+		t.Errorf("Requeued message was dead lettered again: %+v", d)
+	default:
+	}
+
+	if err := inst1.Send(ctx, "dlq", "reject", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d = <-dead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rejected message was not dead lettered")
+	}
+	if d.Reason != tolliver.DeadLetterRejected || d.Detail != "bad input" {
+		t.Errorf("Unexpected dead letter %+v", d)
+	}
+
+	if err := inst1.Purge(ctx, d.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst1.Purge(ctx, d.ID); !errors.Is(err, tolliver.ErrDeadLetterNotFound) {
+		t.Errorf("Expected ErrDeadLetterNotFound, got %v", err)
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	inst1 := newTestInstance(t, caPool, cert1, 0)
+	inst2 := newTestInstance(t, caPool, cert2, 9008)
+	ctx := context.Background()
+
+	inst2.Subscribe(ctx, "cmd", "")
+	inst2.RegisterHandler("cmd", "", func(ctx context.Context, m *tolliver.Message) error {
+		switch m.Key {
+		case "reject":
+			return m.Nack("unknown command")
+		case "ignore":
+			return errors.New("busy")
+		}
+		return nil
+	})
+	connect(t, inst1, 9008)
+
+	receipt, err := inst1.SendAndWait(ctx, "cmd", "shutdown", []byte("now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !receipt.AllAcked() || receipt.Recipients[inst2.ID()].State != tolliver.DeliveryAcked {
+		t.Errorf("Expected inst2 to have acked, got %+v", receipt)
+	}
+
+	receipt, err = inst1.SendAndWait(ctx, "cmd", "reject", nil)
+	if !errors.Is(err, tolliver.ErrDeliveryFailed) {
+		t.Errorf("Expected ErrDeliveryFailed, got %v", err)
+	}
+	if s := receipt.Recipients[inst2.ID()]; s.State != tolliver.DeliveryRejected || s.Reason != "unknown command" {
+		t.Errorf("Unexpected status %+v", s)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	receipt, err = inst1.SendAndWait(timeout, "cmd", "ignore", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if s := receipt.Recipients[inst2.ID()]; s.State != tolliver.DeliveryPending {
+		t.Errorf("Expected pending status, got %+v", s)
+	}
+
+	if _, err := inst1.SendAndWait(ctx, "nobody", "", nil); !errors.Is(err, tolliver.ErrNoRecipients) {
+		t.Errorf("Expected ErrNoRecipients, got %v", err)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	inst1 := newTestInstance(t, caPool, cert1, 0)
+	inst2 := newTestInstance(t, caPool, cert2, 9009)
+	ctx := context.Background()
+
+	inst2.Subscribe(ctx, "math", "")
+	inst2.HandleRequest("math", "double", func(ctx context.Context, m *tolliver.Message) ([]byte, error) {
+		n, err := strconv.Atoi(string(m.Body))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(n * 2)), nil
+	})
+	connect(t, inst1, 9009)
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	reply, err := inst1.Request(timeout, "math", "double", []byte("21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Body) != "42" || reply.Sender != inst2.ID() {
+		t.Errorf("Unexpected reply %q from %v", reply.Body, reply.Sender)
+	}
+
+	_, err = inst1.Request(timeout, "math", "double", []byte("twenty"))
+	var remote *tolliver.RemoteError
+	if !errors.As(err, &remote) || remote.Remote != inst2.ID() {
+		t.Errorf("Expected a RemoteError from inst2, got %v", err)
+	}
+
+	// Nothing handles requests on this key, so no reply ever comes
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := inst1.Request(short, "math", "halve", []byte("42")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	if _, err := inst1.Request(timeout, "nobody", "", nil); !errors.Is(err, tolliver.ErrNoRecipients) {
+		t.Errorf("Expected ErrNoRecipients, got %v", err)
+	}
+}
+
+func TestDurableSubscriptions(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	dbPath := filepath.Join(t.TempDir(), "durable.db")
+	withPath := func(o *tolliver.InstanceOptions) { o.DatabasePath = dbPath }
+	ctx := context.Background()
+
+	before := newTestInstance(t, caPool, cert2, 0, withPath)
+	if err := before.Subscribe(ctx, "durable", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Subscribe(ctx, "durable", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Subscribe(ctx, "dropped", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Unsubscribe(ctx, "dropped", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted instance advertises its saved subscription without the application subscribing again
+	inst2 := newTestInstance(t, caPool, cert2, 9010, withPath)
+	var received atomic.Int32
+	inst2.Register("", "", func(b []byte) bool {
+		received.Add(1)
+		return true
+	})
+	inst1 := newTestInstance(t, caPool, cert1, 0)
+	connect(t, inst1, 9010)
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	receipt, err := inst1.SendAndWait(timeout, "durable", "k", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipt.Recipients) != 1 {
+		t.Errorf("Expected a single recipient, got %+v", receipt.Recipients)
+	}
+	if _, err := inst1.SendAndWait(timeout, "dropped", "k", nil); !errors.Is(err, tolliver.ErrNoRecipients) {
+		t.Errorf("Expected ErrNoRecipients for the removed subscription, got %v", err)
+	}
+	if received.Load() != 1 {
+		t.Errorf("Expected 1 message, got %d", received.Load())
+	}
+}
+
+func TestStoreAndForward(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "offline.db")
+	withPath := func(o *tolliver.InstanceOptions) { o.DatabasePath = dbPath }
+
+	// Resends are pushed far into the future, so only the flush on reconnecting can deliver the queued message
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.RetryInterval = time.Hour
+	})
+
+	offline := newTestInstance(t, caPool, cert2, 9011, withPath)
+	offline.Subscribe(ctx, "offline", "")
+	offline.Subscribe(ctx, "dropped", "")
+	connect(t, inst1, 9011)
+	offline.Unsubscribe(ctx, "dropped", "")
+	if err := offline.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := inst1.Send(ctx, "offline", "k", []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst1.UnreliableSend(ctx, "offline", "k", []byte("lost")); !errors.Is(err, tolliver.ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected from UnreliableSend, got %v", err)
+	}
+
+	inst2 := newTestInstance(t, caPool, cert2, 9011, withPath)
+	received := make(chan string, 2)
+	inst2.Register("", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	connect(t, inst1, 9011)
+
+	select {
+	case b := <-received:
+		if b != "queued" {
+			t.Errorf("Expected the queued message, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued message was not delivered on reconnect")
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := inst1.SendAndWait(timeout, "dropped", "", nil); !errors.Is(err, tolliver.ErrNoRecipients) {
+		t.Errorf("Expected ErrNoRecipients for the dropped subscription, got %v", err)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	inst1 := newTestInstance(t, caPool, cert1, 0)
+	inst2 := newTestInstance(t, caPool, cert2, 9012)
+	ctx := context.Background()
+
+	calls := make(chan string, 20)
+	var failed atomic.Bool
+	inst2.Subscribe(ctx, "state", "")
+	inst2.RegisterHandler("state", "", func(ctx context.Context, m *tolliver.Message) error {
+		calls <- fmt.Sprintf("%s:%d", m.Body, m.Sequence)
+		// The first message fails once, so the later ones arrive first and have to wait for it
+		if string(m.Body) == "a" && !failed.Swap(true) {
+			return errors.New("not yet")
+		}
+		if string(m.Body) == "b" {
+			return m.Nack("bad state")
+		}
+		return nil
+	})
+	connect(t, inst1, 9012)
+
+	for _, b := range []string{"a", "b", "c"} {
+		if err := inst1.Send(ctx, "state", "node1", []byte(b), tolliver.Ordered()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"a:1", "a:1", "b:2", "c:3"}
+	for i, w := range want {
+		select {
+		case got := <-calls:
+			if got != w {
+				t.Fatalf("Call %d was %s, expected %s", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Call %d (%s) never happened", i, w)
+		}
+	}
+
+	// Once the stream has moved on, resends of settled messages don't reach the handler again
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case got := <-calls:
+		t.Errorf("Unexpected extra call %s", got)
+	default:
+	}
+}
+
+func TestOrderedArrivingOutOfOrder(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	receiver := newTestInstance(t, caPool, cert2, 9031)
+	received := make(chan string, 10)
+	receiver.Register("state", "node1", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+
+	// The later message arrives first, as it can when a new send overtakes messages being flushed after a reconnect
+	send := dialRaw(t, caPool, cert1, 9031)
+	send(2, 2, 1, "second")
+	send(1, 1, 1, "first")
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case b := <-received:
+			got = append(got, b)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected both messages to be handled, got %v", got)
+		}
+	}
+	if fmt.Sprint(got) != "[first second]" {
+		t.Errorf("Expected the messages in sequence order, got %v", got)
+	}
+}
+
+// Connects to the instance listening on port as a bare remote, returning a function which sends it an ordered message
+// on channel "state" key "node1", so tests can control exactly what arrives and in what order.
+func dialRaw(t *testing.T, caPool *x509.CertPool, cert tls.Certificate, port int) func(id, seq, first uint64, body string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := binary.NewReader(conn)
+	if _, _, err := handshake.SendTolliverHandshake(conn, r, uuid.Must(uuid.NewV7()), nil, func(uuid.UUID) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// Acks are read and thrown away so they never fill up the connection
+	go io.Copy(io.Discard, conn)
+
+	return func(id, seq, first uint64, body string) {
+		t.Helper()
+		headers := map[string]string{"tolliver-seq": strconv.FormatUint(seq, 10), "tolliver-seq-first": strconv.FormatUint(first, 10)}
+		w := binary.NewWriter()
+		w.WriteAll(byte(3), id, uint64(len("state")), "state", uint64(len("node1")), "node1", headers, uint64(len(body)), body)
+		if _, err := conn.Write(w.Join()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+func TestOrderedBufferFull(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	receiver := newTestInstance(t, caPool, cert2, 9034, func(o *tolliver.InstanceOptions) {
+		o.DedupWindow = time.Minute
+	})
+	var handled atomic.Int32
+	receiver.Register("state", "node1", func(b []byte) bool {
+		handled.Add(1)
+		return true
+	})
+
+	// Everything after the first message arrives before it, which is more than the receiver buffers, so the last one
+	// is dropped until it is resent
+	send := dialRaw(t, caPool, cert1, 9034)
+	const total = 1026
+	for seq := uint64(2); seq <= total; seq++ {
+		send(seq, seq, 1, "later")
+	}
+	send(1, 1, 1, "first")
+	deadline := time.Now().Add(10 * time.Second)
+	for handled.Load() < total-1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	send(total, total, total, "resent")
+
+	for handled.Load() < total && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := handled.Load(); n != total {
+		t.Errorf("Expected all %d messages to be handled, got %d", total, n)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "sender.db")
+	withPath := func(o *tolliver.InstanceOptions) { o.DatabasePath = dbPath }
+
+	inst2 := newTestInstance(t, caPool, cert2, 9013, func(o *tolliver.InstanceOptions) {
+		o.DedupWindow = time.Minute
+	})
+	var handled atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	inst2.Subscribe(ctx, "once", "")
+	inst2.Register("once", "", func(b []byte) bool {
+		if handled.Add(1) == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		return true
+	})
+
+	sender := newTestInstance(t, caPool, cert1, 0, withPath)
+	connect(t, sender, 9013)
+	if err := sender.Send(ctx, "once", "k", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+
+	// The sender goes away before the ack arrives, so it resends the message once it is back
+	if err := sender.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	restarted := newTestInstance(t, caPool, cert1, 0, withPath)
+	connect(t, restarted, 9013)
+	time.Sleep(100 * time.Millisecond)
+
+	if n := handled.Load(); n != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", n)
+	}
+}
+
+func TestSendTx(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	shared, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+	shared.SetMaxOpenConns(1)
+	if _, err := shared.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+
+	inst1 := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Database = shared
+	})
+	inst2 := newTestInstance(t, caPool, cert2, 9014)
+	received := make(chan string, 2)
+	inst2.Subscribe(ctx, "orders", "")
+	inst2.Register("orders", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	connect(t, inst1, 9014)
+
+	for _, commit := range []bool{false, true} {
+		tx, err := shared.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO orders (id) VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+		if err := inst1.SendTx(ctx, tx, "orders", "created", []byte(fmt.Sprint(commit))); err != nil {
+			t.Fatal(err)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case b := <-received:
+		if b != "true" {
+			t.Errorf("Received the message from the rolled back transaction")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Committed message was not delivered")
+	}
+
+	if err := inst1.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared.Ping(); err != nil {
+		t.Errorf("Close closed the application's database: %v", err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T) tolliver.Store {
+			s, err := tolliver.OpenSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		})
+	})
+	t.Run("Memory", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T) tolliver.Store {
+			s, err := tolliver.NewMemoryStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		})
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	withMemory := func(o *tolliver.InstanceOptions) {
+		s, err := tolliver.NewMemoryStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.Store = s
+	}
+
+	inst1 := newTestInstance(t, caPool, cert1, 0, withMemory)
+	inst2 := newTestInstance(t, caPool, cert2, 9015, withMemory)
+	received := make(chan string, 1)
+	inst2.Subscribe(ctx, "mem", "")
+	inst2.Register("mem", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	connect(t, inst1, 9015)
+
+	if _, err := inst1.SendAndWait(ctx, "mem", "k", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		if b != "hello" {
+			t.Errorf("Expected hello, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+
+	shared, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+	tx, err := shared.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := inst1.SendTx(ctx, tx, "mem", "k", []byte("tx")); !errors.Is(err, tolliver.ErrTxUnsupported) {
+		t.Errorf("Expected ErrTxUnsupported, got %v", err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	// The schema and data of a database created before the schema was versioned
+	id, recipient := [16]byte{1}, [16]byte{2}
+	_, err = old.Exec(`
+CREATE TABLE message (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, channel TEXT NOT NULL, key TEXT NOT NULL, data BLOB NOT NULL);
+CREATE TABLE delivery (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, message_id INTEGER NOT NULL, recipient_id BLOB NOT NULL);
+CREATE TABLE instance (uuid BLOB PRIMARY KEY NOT NULL);
+CREATE TABLE subscription (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, channel TEXT, key TEXT, instance_id BLOB NOT NULL);
+INSERT INTO message (channel, key, data) VALUES ('c', 'k', 'old');
+INSERT INTO delivery (message_id, recipient_id) VALUES (1, $1);
+INSERT INTO instance (uuid) VALUES ($2);
+INSERT INTO subscription (channel, key, instance_id) VALUES ('c', '', $1);`, recipient[:], id[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tolliver.NewSQLiteStore(ctx, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.InstanceID(ctx); got != id {
+		t.Errorf("Instance UUID changed from %v to %v", id, got)
+	}
+	pending, err := s.PendingDeliveries(ctx, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || string(pending[0].Body) != "old" || pending[0].Attempts != 0 {
+		t.Errorf("Expected the old delivery to survive the upgrade, got %+v", pending)
+	}
+	subscribers, err := s.Subscribers(ctx, "c", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 1 || subscribers[0] != recipient {
+		t.Errorf("Expected the old subscription to survive the upgrade, got %v", subscribers)
+	}
+	if _, err := s.AddLocalSubscription(ctx, tolliver.Subscription{Channel: "c", Key: "k"}); err != nil {
+		t.Errorf("Tables added since the old schema are missing: %v", err)
+	}
+
+	// Opening an up to date database again leaves it alone
+	if _, err := tolliver.NewSQLiteStore(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.Exec("INSERT INTO schema_version (version, applied_at) VALUES (1000, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tolliver.NewSQLiteStore(ctx, old); !errors.Is(err, tolliver.ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew for a database from a newer version, got %v", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	receiver := newTestInstance(t, caPool, cert2, 9016)
+	release := make(chan struct{})
+	receiver.Subscribe(ctx, "quota", "")
+	receiver.Register("quota", "", func(b []byte) bool {
+		<-release
+		return true
+	})
+
+	rejecting := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Retention = tolliver.RetentionPolicy{Interval: 20 * time.Millisecond, MaxMessages: 1}
+	})
+	connect(t, rejecting, 9016)
+	if err := rejecting.Send(ctx, "quota", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rejecting.Send(ctx, "quota", "2", nil); !errors.Is(err, tolliver.ErrStoreFull) {
+		t.Fatalf("Expected ErrStoreFull while the first message is unacked, got %v", err)
+	}
+
+	store, err := tolliver.NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropping := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Store = store
+		o.Retention = tolliver.RetentionPolicy{MaxMessages: 1, Overflow: tolliver.OverflowDropOldest}
+	})
+	connect(t, dropping, 9016)
+	type result struct {
+		receipt *tolliver.DeliveryReceipt
+		err     error
+	}
+	waited := make(chan result, 1)
+	go func() {
+		r, err := dropping.SendAndWait(ctx, "quota", "1", nil)
+		waited <- result{r, err}
+	}()
+	// The first message has to be saved before the second, so it is the oldest and the one dropped
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := store.PendingDeliveries(ctx, receiver.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("First message was never saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dropping.Send(ctx, "quota", "2", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-waited:
+		if !errors.Is(r.err, tolliver.ErrDeliveryFailed) {
+			t.Errorf("Expected ErrDeliveryFailed for the dropped message, got %v", r.err)
+		}
+		for _, s := range r.receipt.Recipients {
+			if s.State != tolliver.DeliveryDropped {
+				t.Errorf("Expected the delivery to be dropped, got %v", s.State)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dropping the message didn't resolve its receipt")
+	}
+
+	// Once the receiver acks, the collector deletes the message and frees up the quota
+	close(release)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		err := rejecting.Send(ctx, "quota", "3", nil)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, tolliver.ErrStoreFull) || time.Now().After(deadline) {
+			t.Fatalf("Quota was not freed after the message was acked: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	publisher := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Retention = tolliver.RetentionPolicy{Interval: 20 * time.Millisecond, Channels: map[string]time.Duration{"history": time.Hour}}
+	})
+	// Replayed messages are resent like any other until acked, so drop the copies a slow ack causes
+	receiver := newTestInstance(t, caPool, cert2, 9017, func(o *tolliver.InstanceOptions) { o.DedupWindow = time.Minute })
+	connect(t, publisher, 9017)
+
+	start := time.Now()
+	if err := publisher.Send(ctx, "history", "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.UnreliableSend(ctx, "history", "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Send(ctx, "other", "a", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// Give the collector time to delete anything it shouldn't keep
+	time.Sleep(100 * time.Millisecond)
+
+	received := make(chan string, 10)
+	receiver.Register("", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	if err := receiver.SubscribeFrom(ctx, "history", "", start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the replay to arrive before sending anything new, since the two aren't ordered with each other
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case b := <-received:
+			got = append(got, b)
+		case <-timeout:
+			t.Fatalf("Expected the two earlier messages to be replayed, got %v", got)
+		}
+	}
+	if err := publisher.Send(ctx, "history", "a", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		got = append(got, b)
+	case <-timeout:
+		t.Fatalf("New message was not received after the replay, got %v", got)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Expected messages 1, 2 and 3 in order, got %v", got)
+	}
+	select {
+	case b := <-received:
+		t.Errorf("Received unexpected message %q", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRetain(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	publisher := newTestInstance(t, caPool, cert1, 0)
+	if err := publisher.Publish(ctx, "health", "node", []byte("starting"), tolliver.Retain()); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "health", "node", []byte("up"), tolliver.Retain()); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "config", "node", []byte("v2"), tolliver.Retain()); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newTestInstance(t, caPool, cert2, 9018, func(o *tolliver.InstanceOptions) { o.DedupWindow = time.Minute })
+	received := make(chan string, 10)
+	receiver.Register("", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	receiver.Subscribe(ctx, "health", "")
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case b := <-received:
+			if b != want {
+				t.Fatalf("Expected %q, got %q", want, b)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Retained value %q was not delivered", want)
+		}
+	}
+
+	// Sent because of the subscriptions in the handshake
+	connect(t, publisher, 9018)
+	expect("up")
+
+	// Sent because of a subscription message
+	receiver.Subscribe(ctx, "config", "")
+	expect("v2")
+
+	select {
+	case b := <-received:
+		t.Errorf("Received unexpected message %q", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	receiver := newTestInstance(t, caPool, cert2, 9019, func(o *tolliver.InstanceOptions) { o.DedupWindow = time.Minute })
+	shutdowns := make(chan string, 10)
+	all := make(chan string, 10)
+	receiver.Register("vm.*.shutdown", "", func(b []byte) bool {
+		shutdowns <- string(b)
+		return true
+	})
+	receiver.Register("vm.>", "", func(b []byte) bool {
+		all <- string(b)
+		return true
+	})
+	receiver.Subscribe(ctx, "vm.>", "")
+
+	sender := newTestInstance(t, caPool, cert1, 0)
+	connect(t, sender, 9019)
+
+	if err := sender.Send(ctx, "vm.*", "", nil); !errors.Is(err, tolliver.ErrChannelPattern) {
+		t.Fatalf("Expected ErrChannelPattern sending on a pattern, got %v", err)
+	}
+	for _, channel := range []string{"vm.eu.shutdown", "vm.eu.start", "vm", "host.eu.shutdown"} {
+		if err := sender.Send(ctx, channel, "", []byte(channel)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(ch chan string, want string) {
+		t.Helper()
+		select {
+		case b := <-ch:
+			if b != want {
+				t.Fatalf("Expected %q, got %q", want, b)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message on %q was not delivered", want)
+		}
+	}
+	expect(shutdowns, "vm.eu.shutdown")
+	expect(all, "vm.eu.shutdown")
+	expect(all, "vm.eu.start")
+
+	select {
+	case b := <-shutdowns:
+		t.Errorf("Received unexpected shutdown %q", b)
+	case b := <-all:
+		t.Errorf("Received unexpected message %q", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	type delivery struct {
+		worker int
+		body   string
+	}
+	received := make(chan delivery, 100)
+	var stalled atomic.Bool
+	workers := make([]*tolliver.Instance, 2)
+	for i, port := range []uint16{9020, 9021} {
+		workers[i] = newTestInstance(t, caPool, cert2, port, func(o *tolliver.InstanceOptions) { o.DedupWindow = time.Minute })
+		workers[i].Register("jobs", "", func(b []byte) bool {
+			if i == 1 && stalled.Load() {
+				// Never acks, so the sender has to move the message to the other worker
+				return false
+			}
+			received <- delivery{worker: i, body: string(b)}
+			return true
+		})
+		if err := workers[i].SubscribeGroup(ctx, "jobs", "", "workers"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sender := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		// Long enough that the worker which acks is never passed over, even under the race detector
+		o.Backoff = tolliver.BackoffPolicy{Initial: 300 * time.Millisecond, Multiplier: 1, Jitter: -1}
+	})
+	connect(t, sender, 9020)
+	connect(t, sender, 9021)
+
+	collect := func(n int) map[int]int {
+		t.Helper()
+		perWorker := make(map[int]int)
+		bodies := make(map[string]int)
+		for range n {
+			select {
+			case d := <-received:
+				perWorker[d.worker]++
+				bodies[d.body]++
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Only received %d of %d jobs", len(bodies), n)
+			}
+		}
+		select {
+		case d := <-received:
+			t.Fatalf("Job %q was delivered to more than one worker", d.body)
+		case <-time.After(100 * time.Millisecond):
+		}
+		for body, count := range bodies {
+			if count != 1 {
+				t.Errorf("Job %q was processed %d times", body, count)
+			}
+		}
+		return perWorker
+	}
+
+	for i := range 10 {
+		if err := sender.Send(ctx, "jobs", "", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := collect(10); counts[0] != 5 || counts[1] != 5 {
+		t.Errorf("Expected the jobs to be split evenly between the workers, got %v", counts)
+	}
+
+	stalled.Store(true)
+	for i := range 10 {
+		if err := sender.Send(ctx, "jobs", "", []byte(strconv.Itoa(10+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := collect(10); counts[0] != 10 {
+		t.Errorf("Expected every job to end up with the worker which acks, got %v", counts)
+	}
+}
+
+// Makes a certificate for 127.0.0.1 with the given common name and URIs, signed by parent or self signed if parent is
+// nil. The template can be changed further before it is signed.
+func issueCert(t *testing.T, commonName string, uris []*url.URL, parent *tls.Certificate, configure ...func(*x509.Certificate)) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		URIs:         uris,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range configure {
+		c(template)
+	}
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Makes a certificate for 127.0.0.1 which isn't signed by the test CA.
+func untrustedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	return issueCert(t, "intruder.tug.dev", nil, nil)
+}
+
+func TestTLSVerification(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	addr := func(port int, serverName string) tolliver.RemoteAddr {
+		return tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: port}, ServerName: serverName}
+	}
+	newTestInstance(t, caPool, cert2, 9022)
+	untrusted := newTestInstance(t, caPool, untrustedCert(t), 9023)
+
+	var dialErr *tolliver.DialError
+	client := newTestInstance(t, caPool, cert1, 0)
+	if err := client.NewConnection(ctx, addr(9023, "")); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a remote with an untrusted certificate to be refused, got %v", err)
+	}
+	if err := client.NewConnection(ctx, addr(9022, "wrong.tug.dev")); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a remote whose certificate isn't for the server name to be refused, got %v", err)
+	}
+	if err := untrusted.NewConnection(ctx, addr(9022, "")); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a client with an untrusted certificate to be refused, got %v", err)
+	}
+	if err := client.NewConnection(ctx, addr(9022, "gateway.tug.dev")); err != nil {
+		t.Errorf("Expected a remote with a certificate for the server name to be accepted, got %v", err)
+	}
+
+	// Without a server name the certificate has to be valid for the IP which was dialled
+	root, err := tls.LoadX509KeyPair("./testData/root.crt", "./testData/root.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	elsewhere := issueCert(t, "other.tug.dev", nil, &root, func(c *x509.Certificate) {
+		c.IPAddresses = nil
+		c.DNSNames = []string{"other.tug.dev"}
+	})
+	newTestInstance(t, caPool, elsewhere, 9030)
+	if err := client.NewConnection(ctx, addr(9030, "")); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a remote whose certificate isn't for the dialled IP to be refused, got %v", err)
+	}
+	if err := client.NewConnection(ctx, addr(9030, "other.tug.dev")); err != nil {
+		t.Errorf("Expected a remote with a certificate for the server name to be accepted, got %v", err)
+	}
+
+	skip := func(o *tolliver.InstanceOptions) { o.InsecureSkipVerify = true }
+	newTestInstance(t, caPool, cert2, 9024, skip)
+	insecureClient := newTestInstance(t, caPool, untrustedCert(t), 0, skip)
+	if err := insecureClient.NewConnection(ctx, addr(9024, "")); err != nil {
+		t.Errorf("Expected verification to be skipped, got %v", err)
+	}
+}
+
+func TestIdentityPolicy(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	root, err := tls.LoadX509KeyPair("./testData/root.crt", "./testData/root.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Creates an instance whose certificate names the UUID of its store, or a different one if it's an impostor
+	named := func(port uint16, impostor bool, configure ...func(*tolliver.InstanceOptions)) *tolliver.Instance {
+		store, err := tolliver.NewMemoryStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := store.InstanceID(ctx)
+		if impostor {
+			id = uuid.New()
+		}
+		cert := issueCert(t, "node.tug.dev", []*url.URL{{Scheme: "urn", Opaque: "uuid:" + id.String()}}, &root)
+		return newTestInstance(t, caPool, cert, port, append(configure, func(o *tolliver.InstanceOptions) { o.Store = store })...)
+	}
+	requireID := func(o *tolliver.InstanceOptions) { o.Identity.RequireCertificateID = true }
+	addr := func(port int) tolliver.RemoteAddr {
+		return tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: port}}
+	}
+
+	named(9025, false, requireID)
+	if err := named(0, false).NewConnection(ctx, addr(9025)); err != nil {
+		t.Errorf("Expected a remote named in its certificate to be accepted, got %v", err)
+	}
+	var dialErr *tolliver.DialError
+	if err := named(0, true).NewConnection(ctx, addr(9025)); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a remote claiming a UUID its certificate doesn't name to be rejected, got %v", err)
+	}
+
+	// The dialing side checks the remote it reaches too
+	newTestInstance(t, caPool, cert2, 9026)
+	if err := named(0, false, requireID).NewConnection(ctx, addr(9026)); !errors.Is(err, tolliver.ErrIdentityMismatch) {
+		t.Errorf("Expected a server whose certificate doesn't name it to be rejected, got %v", err)
+	}
+
+	pinning := newTestInstance(t, caPool, cert2, 9027, func(o *tolliver.InstanceOptions) { o.Identity.RequirePinned = true })
+	client := newTestInstance(t, caPool, cert1, 0)
+	if err := client.NewConnection(ctx, addr(9027)); !errors.As(err, &dialErr) {
+		t.Errorf("Expected a remote without a pinned certificate to be rejected, got %v", err)
+	}
+	if err := pinning.PinCertificate(ctx, client.ID(), tolliver.CertificateFingerprint(cert1.Leaf)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NewConnection(ctx, addr(9027)); err != nil {
+		t.Errorf("Expected a remote with a pinned certificate to be accepted, got %v", err)
+	}
+	if err := pinning.UnpinCertificate(ctx, client.ID(), tolliver.CertificateFingerprint(cert2.Leaf)); !errors.Is(err, tolliver.ErrPinNotFound) {
+		t.Errorf("Expected unpinning a certificate which isn't pinned to fail, got %v", err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rules, []byte(`[
+		{"common_name": "sparkler.tug.dev", "actions": ["publish"], "channel": "vm.>"},
+		{"common_name": "sparkler.tug.dev", "actions": ["subscribe"], "channel": "status.*", "key": "k"}
+	]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer, err := tolliver.LoadStaticAuthorizer(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestInstance(t, caPool, cert2, 9028, func(o *tolliver.InstanceOptions) { o.Authorizer = authorizer })
+	published := make(chan string, 10)
+	server.Register("", "", func(b []byte) bool {
+		published <- string(b)
+		return true
+	})
+	server.Subscribe(ctx, "", "")
+
+	rejected := make(chan tolliver.Rejection, 10)
+	client := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.OnRejected = func(r tolliver.Rejection) { rejected <- r }
+	})
+	received := make(chan string, 10)
+	client.Register("", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	// Presented in the handshake, where the one which isn't allowed is ignored
+	client.Subscribe(ctx, "status.*", "k")
+	client.Subscribe(ctx, "logs", "")
+	connect(t, client, 9028)
+
+	expectRejection := func(what string) {
+		t.Helper()
+		select {
+		case r := <-rejected:
+			if !r.Denied {
+				t.Errorf("Expected %s to be denied, got %+v", what, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s to be denied", what)
+		}
+	}
+
+	// A subscription message which isn't allowed is nacked
+	client.Subscribe(ctx, "audit", "")
+	expectRejection("the subscription")
+
+	if err := client.Send(ctx, "secrets", "", []byte("denied")); err != nil {
+		t.Fatal(err)
+	}
+	expectRejection("the message")
+	if err := client.Send(ctx, "vm.eu", "", []byte("allowed")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-published:
+		if b != "allowed" {
+			t.Errorf("Expected only the allowed message to be handled, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Allowed message was not handled")
+	}
+
+	for _, channel := range []string{"logs", "audit", "status.eu"} {
+		if err := server.Send(ctx, channel, "k", []byte(channel)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case b := <-received:
+		if b != "status.eu" {
+			t.Errorf("Expected only the allowed subscription to be applied, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message for the allowed subscription was not received")
+	}
+	// Reliable delivery is at least once, so a second copy of the allowed message isn't a failure
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case b := <-received:
+			if b != "status.eu" {
+				t.Errorf("Received %q through a subscription which wasn't allowed", b)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Makes a self signed CA which can issue certificates with issueCert.
+func newCA(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Writes a certificate and, if keyPath isn't blank, its private key as PEM files.
+func writePEM(t *testing.T, cert tls.Certificate, certPath, keyPath string) {
+	t.Helper()
+	if keyPath != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialRotation(t *testing.T) {
+	caPool, cert1, cert2 := testCredentials(t)
+	ctx := context.Background()
+	root, err := tls.LoadX509KeyPair("./testData/root.crt", "./testData/root.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	writePEM(t, cert2, certFile, keyFile)
+	writePEM(t, root, caFile, "")
+
+	server := newTestInstance(t, caPool, cert2, 9029, func(o *tolliver.InstanceOptions) {
+		o.CA, o.InstanceCert = nil, nil
+		o.DedupWindow = time.Minute
+		o.Credentials = tolliver.CredentialPolicy{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, Interval: 20 * time.Millisecond, RecheckPeers: true}
+	})
+	received := make(chan string, 10)
+	server.Register("jobs", "", func(b []byte) bool {
+		received <- string(b)
+		return true
+	})
+	server.Subscribe(ctx, "jobs", "")
+	client := newTestInstance(t, caPool, cert1, 0, func(o *tolliver.InstanceOptions) {
+		o.Credentials = tolliver.CredentialPolicy{Interval: 20 * time.Millisecond, RecheckPeers: true}
+	})
+	addr := tolliver.RemoteAddr{Addr: &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 9029}}
+
+	expect := func(body string) {
+		t.Helper()
+		if err := client.Send(ctx, "jobs", "", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case b := <-received:
+			if b != body {
+				t.Errorf("Expected %q, got %q", body, b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %q was not received", body)
+		}
+	}
+	// Dialing while still connected fails with ErrConnAlreadyExists, so a DialError means the client was disconnected
+	// and one side no longer accepts the other's certificate
+	refused := func() {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			var dialErr *tolliver.DialError
+			err := client.NewConnection(ctx, addr)
+			if errors.As(err, &dialErr) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the client to be disconnected and refused, got %v", err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	connect(t, client, 9029)
+	expect("1")
+
+	// The server moves to a new CA, so the client's certificate no longer verifies and its connection is closed
+	next := newCA(t, "next.tug.dev")
+	writePEM(t, next, caFile, "")
+	refused()
+
+	// Once the client has a certificate from the new CA it can connect again without restarting
+	renewed := issueCert(t, "sparkler.tug.dev", nil, &next)
+	if err := client.UpdateCredentials(&renewed, nil); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, client, 9029)
+	expect("2")
+
+	// When the client drops the old CA the server's certificate no longer verifies, so the client disconnects and keeps
+	// dialing until the server's certificate is replaced too
+	nextPool := x509.NewCertPool()
+	nextPool.AddCert(next.Leaf)
+	if err := client.UpdateCredentials(nil, nextPool); err != nil {
+		t.Fatal(err)
+	}
+	refused()
+	writePEM(t, issueCert(t, "gateway.tug.dev", nil, &next), certFile, keyFile)
+
+	// Wait until the server presents its new certificate, which the client then reconnects with
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{Certificates: []tls.Certificate{renewed}, RootCAs: nextPool})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never presented its new certificate: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	expect("3")
 }